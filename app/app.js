@@ -165,26 +165,31 @@ async function uploadVideoFile(videoID) {
 
 async function getVideos() {
   try {
-    const res = await fetch('/api/videos', {
-      method: 'GET',
-      headers: {
-        Authorization: `Bearer ${localStorage.getItem('token')}`,
-      },
-    });
-    if (!res.ok) {
-      const data = await res.json();
-      throw new Error(`Failed to get videos. Error: ${data.error}`);
-    }
-
-    const videos = await res.json();
     const videoList = document.getElementById('video-list');
     videoList.innerHTML = '';
-    for (const video of videos) {
-      const listItem = document.createElement('li');
-      listItem.textContent = video.title;
-      listItem.onclick = () => getVideo(video.id);
-      videoList.appendChild(listItem);
-    }
+    let cursor = null;
+    do {
+      const query = cursor ? `?cursor=${encodeURIComponent(cursor)}` : '';
+      const res = await fetch(`/api/videos${query}`, {
+        method: 'GET',
+        headers: {
+          Authorization: `Bearer ${localStorage.getItem('token')}`,
+        },
+      });
+      if (!res.ok) {
+        const data = await res.json();
+        throw new Error(`Failed to get videos. Error: ${data.error}`);
+      }
+
+      const page = await res.json();
+      for (const video of page.videos) {
+        const listItem = document.createElement('li');
+        listItem.textContent = video.title;
+        listItem.onclick = () => getVideo(video.id);
+        videoList.appendChild(listItem);
+      }
+      cursor = page.next_cursor;
+    } while (cursor);
   } catch (error) {
     alert(`Error: ${error.message}`);
   }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+)
+
+const (
+	deletionRetryInterval = time.Minute
+	deletionBatchSize     = 50
+	maxDeletionBackoff    = 24 * time.Hour
+)
+
+// videoAssetKeys collects every storage key that belongs to a video: the
+// tracked assets plus whatever the URL columns point at, for videos uploaded
+// before assets were tracked.
+func (cfg *apiConfig) videoAssetKeys(video database.Video) ([]string, error) {
+	assets, err := cfg.db.GetVideoAssets(video.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	keys := []string{}
+	add := func(key string) {
+		if key == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	for _, asset := range assets {
+		add(asset.Key)
+	}
+	add(cfg.storedKey(video.VideoKey, video.VideoURL))
+	add(cfg.storedKey(video.ThumbnailKey, video.ThumbnailURL))
+	add(cfg.storedKey(video.HLSKey, nil))
+	add(cfg.storedKey(video.DASHKey, nil))
+	return keys, nil
+}
+
+// releaseAsset stops tracking a replaced asset for the video. The object
+// itself is left to the garbage collector once no video tracks it and the
+// grace period has passed.
+func (cfg *apiConfig) releaseAsset(videoID uuid.UUID, key string) {
+	if key == "" {
+		return
+	}
+	if err := cfg.db.DeleteVideoAsset(videoID, key); err != nil {
+		log.Printf("Couldn't release asset %s: %v", key, err)
+	}
+}
+
+// releaseAssetPrefix stops tracking every asset of the video under prefix,
+// e.g. the segments of a replaced set of renditions.
+func (cfg *apiConfig) releaseAssetPrefix(videoID uuid.UUID, prefix string) {
+	if err := cfg.db.DeleteVideoAssetsWithPrefix(videoID, prefix); err != nil {
+		log.Printf("Couldn't release assets under %s: %v", prefix, err)
+	}
+}
+
+// deleteAssets removes keys from storage. Keys must already be enqueued with
+// EnqueueAssetDeletions; successful deletes are dequeued and failures are
+// rescheduled with exponential backoff. Keys a video uses again by now, the
+// same content uploaded once more, are dequeued and kept.
+func (cfg *apiConfig) deleteAssets(ctx context.Context, deletions []database.AssetDeletion) {
+	for _, d := range deletions {
+		referenced, err := cfg.db.IsAssetReferenced(d.Key)
+		if err != nil {
+			log.Printf("Couldn't check references to %s: %v", d.Key, err)
+			continue
+		}
+		if referenced {
+			if err := cfg.db.DeleteAssetDeletion(d.Key); err != nil {
+				log.Printf("Couldn't dequeue deletion of %s: %v", d.Key, err)
+			}
+			continue
+		}
+		err = cfg.store.Delete(ctx, d.Key)
+		if err != nil {
+			backoff := time.Minute << min(d.Attempts, 20)
+			if backoff > maxDeletionBackoff {
+				backoff = maxDeletionBackoff
+			}
+			log.Printf("Couldn't delete asset %s (attempt %d): %v", d.Key, d.Attempts+1, err)
+			if err := cfg.db.MarkAssetDeletionFailed(d.Key, err, time.Now().Add(backoff)); err != nil {
+				log.Printf("Couldn't record failed deletion of %s: %v", d.Key, err)
+			}
+			continue
+		}
+		if err := cfg.db.DeleteAssetDeletion(d.Key); err != nil {
+			log.Printf("Couldn't dequeue deletion of %s: %v", d.Key, err)
+		}
+	}
+}
+
+// retryAssetDeletions periodically works through the deletion queue until ctx is done.
+func (cfg *apiConfig) retryAssetDeletions(ctx context.Context) {
+	ticker := time.NewTicker(deletionRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		due, err := cfg.db.GetDueAssetDeletions(time.Now(), deletionBatchSize)
+		if err != nil {
+			log.Printf("Couldn't load pending asset deletions: %v", err)
+			continue
+		}
+		cfg.deleteAssets(ctx, due)
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
+	"errors"
 	"fmt"
-	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"path"
 	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+	"github.com/gpr3211/boot-s3-course/internal/storage"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -16,27 +22,173 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	return nil
 }
 
-func getAssetPath(mediaType string) string {
-	r := make([]byte, 32)
-	rand.Read(r)
-	finalName := base64.RawURLEncoding.EncodeToString(r)
-
-	ext := mediaTypeToExt(mediaType)
-	return fmt.Sprintf("%s%s", finalName, ext)
-}
-
-func (cfg apiConfig) getAssetDiskPath(assetPath string) string {
-	return filepath.Join(cfg.assetsRoot, assetPath)
-}
-
-func (cfg apiConfig) getAssetURL(assetPath string) string {
-	return fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, assetPath)
+// videoExtensions covers types whose subtype isn't their file extension.
+var videoExtensions = map[string]string{
+	"video/quicktime":  ".mov",
+	"video/x-matroska": ".mkv",
+	"video/x-msvideo":  ".avi",
 }
 
 func mediaTypeToExt(mediaType string) string {
+	if ext, ok := videoExtensions[mediaType]; ok {
+		return ext
+	}
 	parts := strings.Split(mediaType, "/")
 	if len(parts) != 2 {
 		return ".bin"
 	}
 	return "." + parts[1]
 }
+
+// assetKeyFromURL recovers the storage key from a URL built by a BlobStore.
+func assetKeyFromURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	return strings.TrimPrefix(key, "assets/")
+}
+
+// storedKey returns the storage key of an asset. Rows written before keys
+// were stored only have a URL, and at the time thumbnails were always on local
+// disk and videos always on S3, so the key in the URL only counts if the URL
+// points into the current store. Assets elsewhere have no key here; their URL
+// is served as it is and they are never deleted through the store.
+func (cfg *apiConfig) storedKey(key, rawURL *string) string {
+	if key != nil {
+		return *key
+	}
+	if rawURL == nil {
+		return ""
+	}
+	k := assetKeyFromURL(*rawURL)
+	if k == "" {
+		return ""
+	}
+	// building a URL doesn't reach the store, presigning included
+	own, err := cfg.store.URL(context.Background(), k)
+	if err != nil || !sameLocation(*rawURL, own) {
+		return ""
+	}
+	return k
+}
+
+// sameLocation compares URLs ignoring their query, e.g. a presigned URL's
+// signature.
+func sameLocation(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host && ua.Path == ub.Path
+}
+
+// signVideo fills in the video's URLs from its storage keys. URLs are built
+// per request because the store may hand out short lived presigned links.
+// Only viewer, uuid.Nil for anonymous requests, gets a stream URL if they own
+// the video. Local storage doesn't serve videos by their key, so there the
+// stream URL is also the video URL.
+func (cfg *apiConfig) signVideo(ctx context.Context, video database.Video, viewer uuid.UUID) (database.Video, error) {
+	if key := cfg.storedKey(video.VideoKey, video.VideoURL); key != "" {
+		var stream *string
+		if viewer != uuid.Nil && viewer == video.UserID {
+			u := cfg.streamURL(video.ID)
+			stream = &u
+		}
+		video.StreamURL = stream
+		if cfg.storesLocally() {
+			video.VideoURL = stream
+		} else {
+			u, err := cfg.store.URL(ctx, key)
+			if err != nil {
+				return database.Video{}, err
+			}
+			video.VideoURL = &u
+		}
+	}
+	// segments are fetched relative to the manifest, so with presigned S3
+	// URLs only the manifest itself is signed; use the CloudFront signed cookies
+	// of /api/videos/{videoID}/cdn-cookies or a public origin for HLS/DASH
+	// playback from private storage
+	if video.HLSKey != nil {
+		u, err := cfg.store.URL(ctx, *video.HLSKey)
+		if err != nil {
+			return database.Video{}, err
+		}
+		video.HLSURL = &u
+	}
+	if video.DASHKey != nil {
+		u, err := cfg.store.URL(ctx, *video.DASHKey)
+		if err != nil {
+			return database.Video{}, err
+		}
+		video.DASHURL = &u
+	}
+	if video.ThumbnailVariantKeys != nil {
+		video.ThumbnailVariants = database.ThumbnailVariants{}
+		for format, widths := range video.ThumbnailVariantKeys {
+			video.ThumbnailVariants[format] = map[int]string{}
+			for width, key := range widths {
+				u, err := cfg.store.URL(ctx, key)
+				if err != nil {
+					return database.Video{}, err
+				}
+				video.ThumbnailVariants[format][width] = u
+			}
+		}
+	}
+	if key := cfg.storedKey(video.ThumbnailKey, video.ThumbnailURL); key != "" {
+		u, err := cfg.thumbnailURL(ctx, video, key)
+		if err != nil {
+			return database.Video{}, err
+		}
+		video.ThumbnailURL = &u
+	}
+	return video, nil
+}
+
+// thumbnailURL is where clients load the video's thumbnail stored at key.
+// Local storage goes through the thumbnail endpoint, versioned with the ETag
+// so browsers can cache it for good; other stores hand out their own URL
+// rather than a lookup per listed video.
+func (cfg *apiConfig) thumbnailURL(ctx context.Context, video database.Video, key string) (string, error) {
+	if !cfg.storesLocally() {
+		return cfg.store.URL(ctx, key)
+	}
+	u := fmt.Sprintf("/api/thumbnails/%s", video.ID)
+	info, err := cfg.store.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		// answered with 404 until the file is back
+		return u, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return u + "?v=" + strings.Trim(thumbnailETag(info), `"`), nil
+}
+
+// storesLocally reports whether assets are on this server's disk rather than
+// behind a URL of their own.
+func (cfg *apiConfig) storesLocally() bool {
+	_, ok := cfg.store.(*storage.LocalStore)
+	return ok
+}
+
+// privateAssets keeps processed videos and source masters out of the public
+// /assets/ file server; they are played through the stream
+// endpoint, which checks who is asking. Renditions stay public, players fetch
+// their segments without credentials.
+func privateAssets(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Ext(r.URL.Path) == ".mp4" || strings.Contains(r.URL.Path, "/source/") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
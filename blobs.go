@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+)
+
+// Uploads are stored under the SHA-256 of their content, so the same video or
+// thumbnail uploaded twice is stored once. The blobs table counts the videos
+// using each one and everything derived from a blob, renditions, candidates
+// and variants, lives under derivedPrefix of its key and is shared with it.
+
+// contentKey names an object after the hex SHA-256 of its content.
+func contentKey(sum, mediaType string) string {
+	return sum + mediaTypeToExt(mediaType)
+}
+
+// derivedPrefix is where objects derived from a blob live: abc.mp4 -> abc/
+func derivedPrefix(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "/"
+}
+
+// hashFile returns the hex SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reclaimBlob cancels queued deletions of the blob at key and everything
+// derived from it, before it is stored again. A deletion that fails is
+// retried, and would otherwise remove the new copy.
+func (cfg *apiConfig) reclaimBlob(key string) error {
+	return cfg.db.CancelAssetDeletions(key, derivedPrefix(key))
+}
+
+// recordDerivedSize adds up what is stored under the blob at key for the
+// quotas of the videos using it.
+func (cfg *apiConfig) recordDerivedSize(ctx context.Context, key string) {
+	objects, err := cfg.store.List(ctx, derivedPrefix(key))
+	if err != nil {
+		log.Printf("Couldn't list objects derived from %s: %v", key, err)
+		return
+	}
+	var size int64
+	for _, obj := range objects {
+		size += obj.Size
+	}
+	if err := cfg.db.SetBlobDerivedSize(key, size); err != nil {
+		log.Printf("Couldn't record size of objects derived from %s: %v", key, err)
+	}
+}
+
+// releaseBlob drops the video's reference to the object at key and stops
+// tracking it, and everything derived from it, for the video. Objects no
+// video tracks anymore are left to the garbage collector.
+func (cfg *apiConfig) releaseBlob(videoID uuid.UUID, key string) {
+	if key == "" {
+		return
+	}
+	if _, err := cfg.db.ReleaseBlob(key); err != nil {
+		log.Printf("Couldn't release blob %s: %v", key, err)
+	}
+	cfg.releaseAsset(videoID, key)
+	cfg.releaseAssetPrefix(videoID, derivedPrefix(key))
+}
+
+// unsharedKeys leaves out of keys, about to be deleted with video, the blobs
+// other videos still use along with everything derived from them.
+func (cfg *apiConfig) unsharedKeys(video database.Video, keys []string) ([]string, error) {
+	shared := []string{}
+	for _, key := range []string{cfg.storedKey(video.VideoKey, nil), cfg.storedKey(video.ThumbnailKey, nil)} {
+		if key == "" {
+			continue
+		}
+		blob, err := cfg.db.GetBlob(key)
+		if err != nil {
+			return nil, err
+		}
+		if blob.RefCount > 1 {
+			shared = append(shared, key)
+		}
+	}
+
+	out := []string{}
+	for _, key := range keys {
+		keep := true
+		for _, s := range shared {
+			if key == s || strings.HasPrefix(key, derivedPrefix(s)) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, key)
+		}
+	}
+	return out, nil
+}
+
+// releaseVideoBlobs drops the references of a deleted video.
+func (cfg *apiConfig) releaseVideoBlobs(video database.Video) {
+	for _, key := range []string{cfg.storedKey(video.VideoKey, nil), cfg.storedKey(video.ThumbnailKey, nil)} {
+		if key == "" {
+			continue
+		}
+		if _, err := cfg.db.ReleaseBlob(key); err != nil {
+			log.Printf("Couldn't release blob %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Clients can have uploads checked end to end with RFC 9530 digests. On a
+// form upload:
+//   - Repr-Digest on the request covers the video file's bytes
+//   - Content-Digest on the request covers the request body as sent, the
+//     multipart encoding with its boundaries included
+//   - a video_digest field, sent before the video, covers the video file's
+//     bytes; browsers building the form with FormData can't set headers on
+//     its parts, so this or Repr-Digest is how they send a digest
+//   - Content-Digest on the video part covers the video file's bytes
+//
+// On tus, Repr-Digest on creation covers the whole upload and Content-Digest
+// on a PATCH covers that chunk. Only sha-256 is checked, other algorithms are
+// ignored, and every digest sent has to match.
+
+// maxDigestFieldSize caps the video_digest form field.
+const maxDigestFieldSize = 1 << 10
+
+// parseDigest returns the sha-256 digest in a Content-Digest or Repr-Digest
+// header, e.g. sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:
+// It returns nil if the header has none.
+func parseDigest(header string) ([]byte, error) {
+	for _, member := range strings.Split(header, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(alg), "sha-256") {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, errors.New("sha-256 digest must be a byte sequence, :base64:")
+		}
+		sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			return nil, err
+		}
+		if len(sum) != sha256.Size {
+			return nil, errors.New("sha-256 digest must be 32 bytes")
+		}
+		return sum, nil
+	}
+	return nil, nil
+}
+
+// digestHeader formats a hex SHA-256 as a Content-Digest/Repr-Digest value.
+func digestHeader(sum string) string {
+	b, err := hex.DecodeString(sum)
+	if err != nil {
+		return ""
+	}
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(b) + ":"
+}
+
+// checkDigest rejects the upload when want, a digest the client sent, isn't
+// got, the SHA-256 of what was received.
+func checkDigest(want, got []byte) error {
+	if want == nil || bytes.Equal(want, got) {
+		return nil
+	}
+	return reject(http.StatusBadRequest, "Upload doesn't match its digest",
+		fmt.Errorf("expected sha-256 %x, received %x", want, got))
+}
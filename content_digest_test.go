@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestParseDigest(t *testing.T) {
+	sum := sha256.Sum256([]byte("hello"))
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+	short := base64.StdEncoding.EncodeToString(sum[:16])
+
+	tests := []struct {
+		name    string
+		header  string
+		want    []byte
+		wantErr bool
+	}{
+		{"missing", "", nil, false},
+		{"sha-256", "sha-256=:" + b64 + ":", sum[:], false},
+		{"algorithm is case insensitive", "SHA-256=:" + b64 + ":", sum[:], false},
+		{"spaces around members", "  sha-256 = :" + b64 + ":  ", sum[:], false},
+		{"among other algorithms", "sha-512=:AAAA:, sha-256=:" + b64 + ":", sum[:], false},
+		{"only other algorithms", "md5=:AAAA:, sha-512=:AAAA:", nil, false},
+		{"not a member", "sha-256", nil, false},
+		{"not a byte sequence", "sha-256=" + b64, nil, true},
+		{"unterminated byte sequence", "sha-256=:" + b64, nil, true},
+		{"bad base64", "sha-256=:not base64!:", nil, true},
+		{"wrong length", "sha-256=:" + short + ":", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDigest(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDigest(%q) error = %v, want error %v", tt.header, err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("parseDigest(%q) = %x, want %x", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDigestHeaderRoundTrip(t *testing.T) {
+	const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	got, err := parseDigest(digestHeader(sum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256([]byte("hello"))
+	if !bytes.Equal(got, want[:]) {
+		t.Errorf("parseDigest(digestHeader()) = %x, want %s", got, sum)
+	}
+	if h := digestHeader("not hex"); h != "" {
+		t.Errorf("digestHeader(invalid) = %q, want empty", h)
+	}
+}
+
+func TestCheckDigest(t *testing.T) {
+	hello := sha256.Sum256([]byte("hello"))
+	world := sha256.Sum256([]byte("world"))
+
+	tests := []struct {
+		name      string
+		want, got []byte
+		reject    bool
+	}{
+		{"no digest sent", nil, hello[:], false},
+		{"matches", hello[:], hello[:], false},
+		{"differs", hello[:], world[:], true},
+		{"truncated", hello[:16], hello[:], true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDigest(tt.want, tt.got)
+			if !tt.reject {
+				if err != nil {
+					t.Fatalf("checkDigest() = %v, want nil", err)
+				}
+				return
+			}
+			var rej *uploadRejection
+			if !errors.As(err, &rej) {
+				t.Fatalf("checkDigest() = %v, want an upload rejection", err)
+			}
+			if rej.status != http.StatusBadRequest {
+				t.Errorf("rejection status = %d, want %d", rej.status, http.StatusBadRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// packageDASH segments the encoded renditions into fragmented MP4 and writes
+// manifest.mpd to outDir without re-encoding. Every video rendition goes into
+// one adaptation set; the audio of the richest rendition is the only audio
+// representation since the renditions share the same source track.
+func packageDASH(ctx context.Context, renditions []string, ladder []rendition, outDir string, withAudio bool) error {
+	args := []string{"-y"}
+	for _, r := range renditions {
+		args = append(args, "-i", r)
+	}
+	for i := range renditions {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+	}
+	adaptationSets := "id=0,streams=v"
+	if withAudio {
+		best := 0
+		for i, r := range ladder {
+			if r.AudioBitrate > ladder[best].AudioBitrate {
+				best = i
+			}
+		}
+		args = append(args, "-map", fmt.Sprintf("%d:a:0", best))
+		adaptationSets += " id=1,streams=a"
+	}
+	args = append(args,
+		"-c", "copy",
+		"-f", "dash",
+		"-seg_duration", strconv.Itoa(segmentSeconds),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		"-adaptation_sets", adaptationSets,
+		filepath.Join(outDir, "manifest.mpd"),
+	)
+	if err := runFFmpeg(ctx, args...); err != nil {
+		return fmt.Errorf("ffmpeg dash failed: %w", err)
+	}
+	return nil
+}
+
+func dashContentType(name string) string {
+	switch path.Ext(name) {
+	case ".mpd":
+		return "application/dash+xml"
+	case ".m4s":
+		return "video/iso.segment"
+	default:
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gpr3211/boot-s3-course/internal/auth"
+	"github.com/gpr3211/boot-s3-course/internal/storage"
+)
+
+type gcReport struct {
+	DryRun  bool                 `json:"dry_run"`
+	Scanned int                  `json:"scanned"`
+	Removed []storage.ObjectInfo `json:"removed"`
+	Failed  []string             `json:"failed"`
+}
+
+// collectGarbage deletes stored objects that no video references and that are
+// older than the grace period. With dryRun set it only reports what it would remove.
+func (cfg *apiConfig) collectGarbage(ctx context.Context, dryRun bool) (gcReport, error) {
+	report := gcReport{DryRun: dryRun, Removed: []storage.ObjectInfo{}, Failed: []string{}}
+
+	// load references before listing so anything uploaded meanwhile is newer than the cutoff
+	keys, urls, err := cfg.db.GetReferencedAssets()
+	if err != nil {
+		return report, err
+	}
+	referenced := map[string]bool{}
+	for _, key := range keys {
+		referenced[key] = true
+	}
+	for _, u := range urls {
+		referenced[assetKeyFromURL(u)] = true
+	}
+
+	objects, err := cfg.store.List(ctx, "")
+	if err != nil {
+		return report, err
+	}
+	report.Scanned = len(objects)
+
+	cutoff := time.Now().Add(-cfg.gcGracePeriod)
+	for _, obj := range objects {
+		if referenced[obj.Key] || obj.LastModified.After(cutoff) {
+			continue
+		}
+		if !dryRun {
+			if err := cfg.store.Delete(ctx, obj.Key); err != nil {
+				log.Printf("GC couldn't delete %s: %v", obj.Key, err)
+				report.Failed = append(report.Failed, obj.Key)
+				continue
+			}
+		}
+		report.Removed = append(report.Removed, obj)
+	}
+	return report, nil
+}
+
+// runGC collects garbage every interval until ctx is done.
+func (cfg *apiConfig) runGC(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := cfg.collectGarbage(ctx, false)
+		if err != nil {
+			log.Printf("GC failed: %v", err)
+			continue
+		}
+		log.Printf("GC scanned %d objects, removed %d, failed %d", report.Scanned, len(report.Removed), len(report.Failed))
+	}
+}
+
+func (cfg *apiConfig) handlerGC(w http.ResponseWriter, r *http.Request) {
+	if !cfg.checkAdmin(w, r) {
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") != "false"
+	report, err := cfg.collectGarbage(r.Context(), dryRun)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't collect garbage", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// checkAdmin verifies the ApiKey authorization header against ADMIN_API_KEY
+// and responds with an error when it doesn't match.
+func (cfg *apiConfig) checkAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if cfg.adminAPIKey == "" {
+		respondWithError(w, http.StatusForbidden, "Admin API is disabled", nil)
+		return false
+	}
+	key, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find API key", err)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(cfg.adminAPIKey)) != 1 {
+		respondWithError(w, http.StatusUnauthorized, "Invalid API key", nil)
+		return false
+	}
+	return true
+}
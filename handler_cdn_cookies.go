@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/auth"
+)
+
+// handlerCDNCookies hands the owner of a video CloudFront signed cookies for
+// what is derived from it, renditions, segments and thumbnails, so players
+// can fetch them without signing every URL. Like the stream URL they are
+// only for the owner. The cookies' path is the video's, so those of several
+// videos don't replace each other.
+func (cfg *apiConfig) handlerCDNCookies(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	if cfg.s3CfDistribution == "" || cfg.cdnSigner == nil {
+		respondWithError(w, http.StatusNotFound, "Signed cookies are not enabled", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't view this video", nil)
+		return
+	}
+	key := cfg.storedKey(video.VideoKey, video.VideoURL)
+	if key == "" {
+		respondWithError(w, http.StatusNotFound, "Video has not been processed yet", nil)
+		return
+	}
+
+	prefix := derivedPrefix(key)
+	resource := fmt.Sprintf("https://%s/%s*", cfg.s3CfDistribution, prefix)
+	cookies, err := cfg.cdnSigner.SignedCookies(resource, time.Now().Add(cfg.cdnURLExpiry))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign cookies", err)
+		return
+	}
+	for _, cookie := range cookies {
+		cookie.Domain = cfg.cdnCookieDomain
+		cookie.Path = "/" + prefix
+		http.SetCookie(w, cookie)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
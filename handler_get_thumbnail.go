@@ -1 +1,120 @@
 package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/storage"
+)
+
+// thumbnailMaxAge is how long clients may reuse a thumbnail fetched without
+// a version before checking back with its ETag.
+const thumbnailMaxAge = 5 * time.Minute
+
+// handlerThumbnailGet serves the video's current thumbnail from storage.
+// Thumbnails are replaced under a new key, so the ETag names one exact image:
+// requests carrying it as ?v= are cached for a year, the plain URL is
+// revalidated after a few minutes with If-None-Match/If-Modified-Since.
+func (cfg *apiConfig) handlerThumbnailGet(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	key := cfg.storedKey(video.ThumbnailKey, video.ThumbnailURL)
+	if key == "" && video.ThumbnailURL != nil {
+		// uploaded before keys were stored, to a different store
+		http.Redirect(w, r, *video.ThumbnailURL, http.StatusTemporaryRedirect)
+		return
+	}
+	if video.ID == uuid.Nil || key == "" {
+		respondWithError(w, http.StatusNotFound, "Thumbnail not found", nil)
+		return
+	}
+
+	info, err := cfg.store.Stat(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Thumbnail not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail", err)
+		return
+	}
+
+	etag := thumbnailETag(info)
+	w.Header().Set("ETag", etag)
+	if !info.LastModified.IsZero() {
+		w.Header().Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if r.URL.Query().Get("v") == strings.Trim(etag, `"`) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(thumbnailMaxAge.Seconds())))
+	}
+	if notModified(r, etag, info.LastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, info, err := cfg.store.Get(r.Context(), key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail", err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, body); err != nil {
+		log.Printf("Couldn't send thumbnail %s: %v", key, err)
+	}
+}
+
+// thumbnailETag is a strong validator built from the object's identity.
+func thumbnailETag(info storage.ObjectInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", info.Key, info.Size, info.LastModified.UnixNano())))
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since
+// when the client sent no ETag, as RFC 9110 requires.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || modified.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have one second resolution
+	return !modified.Truncate(time.Second).After(t)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/auth"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+)
+
+type thumbnailCandidate struct {
+	Index    int    `json:"index"`
+	URL      string `json:"url"`
+	Selected bool   `json:"selected"`
+}
+
+func (cfg *apiConfig) handlerThumbnailCandidatesGet(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't view this video's thumbnails", nil)
+		return
+	}
+
+	assets, err := cfg.db.GetVideoAssetsByKind(videoID, database.AssetKindThumbnailCandidate)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail candidates", err)
+		return
+	}
+	current := cfg.storedKey(video.ThumbnailKey, video.ThumbnailURL)
+	candidates := []thumbnailCandidate{}
+	for i, asset := range assets {
+		u, err := cfg.store.URL(r.Context(), asset.Key)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't build thumbnail URL", err)
+			return
+		}
+		candidates = append(candidates, thumbnailCandidate{
+			Index:    i,
+			URL:      u,
+			Selected: asset.Key == current,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, candidates)
+}
+
+// handlerThumbnailSelect makes one of the extracted candidates the video's
+// thumbnail.
+func (cfg *apiConfig) handlerThumbnailSelect(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Candidate int `json:"candidate"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't update this video", nil)
+		return
+	}
+
+	assets, err := cfg.db.GetVideoAssetsByKind(videoID, database.AssetKindThumbnailCandidate)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail candidates", err)
+		return
+	}
+	if params.Candidate < 0 || params.Candidate >= len(assets) {
+		respondWithError(w, http.StatusBadRequest, "No such thumbnail candidate", nil)
+		return
+	}
+
+	oldKey := cfg.storedKey(video.ThumbnailKey, video.ThumbnailURL)
+	key := assets[params.Candidate].Key
+	variants, err := cfg.thumbnailVariants(key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get thumbnail variants", err)
+		return
+	}
+	video.ThumbnailKey = &key
+	video.ThumbnailVariantKeys = variants
+	video.ThumbnailURL = nil
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	cfg.releaseThumbnail(videoID, oldKey)
+
+	video, err = cfg.signVideo(r.Context(), video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't build thumbnail URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, video)
+}
@@ -1,15 +1,27 @@
 package main
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/google/uuid"
 	"github.com/gpr3211/boot-s3-course/internal/auth"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+	"github.com/gpr3211/boot-s3-course/internal/media"
 	"io"
 	"mime"
 	"net/http"
 	"os"
 )
 
+const maxThumbnailSize = 10 << 20 // 10 MB
+
+// maxThumbnailUploadSize caps the whole form, the thumbnail and some room
+// for the multipart encoding and other fields.
+const maxThumbnailUploadSize = maxThumbnailSize + 1<<20
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
 
 	videoIDString := r.PathValue("videoID")
@@ -31,8 +43,16 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	const maxMemory = 10 << 20 // 10 MB
-	r.ParseMultipartForm(maxMemory)
+	r.Body = http.MaxBytesReader(w, r.Body, maxThumbnailUploadSize)
+	if err := r.ParseMultipartForm(maxThumbnailSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail is too large", err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form", err)
+		return
+	}
 
 	file, header, err := r.FormFile("thumbnail")
 	if err != nil {
@@ -47,41 +67,161 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	if mediaType != "image/jpeg" && mediaType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+		respondWithError(w, http.StatusUnsupportedMediaType, "Invalid file type", nil)
 		return
 	}
 
-	assetPath := getAssetPath(mediaType)
-	assetDiskPath := cfg.getAssetDiskPath(assetPath)
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
 
-	dst, err := os.Create(assetDiskPath)
+	data, err := io.ReadAll(io.LimitReader(file, maxThumbnailSize+1))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to create file on server", err)
+		respondWithError(w, http.StatusBadRequest, "Unable to read file", err)
 		return
 	}
-	defer dst.Close()
-	if _, err = io.Copy(dst, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
+	if len(data) > maxThumbnailSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Thumbnail is too large", nil)
+		return
+	}
+	left, _, err := cfg.storageLeft(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+	if int64(len(data)) > left {
+		respondWithUploadError(w, "Couldn't check storage quota", errStorageQuota(left))
+		return
+	}
+	err = cfg.validateImage(data, mediaType)
+	if err != nil {
+		respondWithUploadError(w, "Couldn't validate thumbnail", err)
 		return
 	}
-	fmt.Println("thumb uploaded")
 
-	video, err := cfg.db.GetVideo(videoID)
+	// camera metadata can carry the uploader's location
+	data, err = media.StripMetadata(data, mediaType)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		respondWithError(w, http.StatusUnsupportedMediaType, "Couldn't read image metadata", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+	// the same image uploaded again, e.g. for another video, is stored once
+	sum := sha256.Sum256(data)
+	assetPath := contentKey(hex.EncodeToString(sum[:]), mediaType)
+	oldKey := cfg.storedKey(video.ThumbnailKey, video.ThumbnailURL)
+	if assetPath == oldKey {
+		cfg.respondWithVideo(w, r, video)
+		return
+	}
+	err = cfg.reclaimBlob(assetPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record thumbnail blob", err)
+		return
+	}
+	refs, err := cfg.db.AcquireBlob(assetPath, hex.EncodeToString(sum[:]), int64(len(data)))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record thumbnail blob", err)
+		return
+	}
+	updated := false
+	defer func() {
+		if !updated {
+			cfg.releaseBlob(videoID, assetPath)
+		}
+	}()
+
+	err = cfg.db.CreateVideoAsset(videoID, assetPath, database.AssetKindThumbnail)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record thumbnail asset", err)
 		return
 	}
+	var variants database.ThumbnailVariants
+	if refs > 1 {
+		variants, err = cfg.shareThumbnail(r.Context(), videoID, assetPath)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't share stored thumbnail", err)
+			return
+		}
+	}
+	if variants == nil {
+		variants, err = cfg.storeThumbnail(r.Context(), videoID, assetPath, data, mediaType)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't store thumbnail", err)
+			return
+		}
+		cfg.recordDerivedSize(r.Context(), assetPath)
+	}
 
-	url := cfg.getAssetURL(assetPath)
-	video.ThumbnailURL = &url
+	video.ThumbnailKey = &assetPath
+	video.ThumbnailVariantKeys = variants
+	video.ThumbnailURL = nil
 	err = cfg.db.UpdateVideo(video)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
+	updated = true
+	cfg.releaseThumbnail(videoID, oldKey)
+
+	cfg.respondWithVideo(w, r, video)
+}
+
+// respondWithVideo answers the owner of video with it.
+func (cfg *apiConfig) respondWithVideo(w http.ResponseWriter, r *http.Request, video database.Video) {
+	video, err := cfg.signVideo(r.Context(), video, video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
 	respondWithJSON(w, http.StatusOK, video)
 }
+
+// storeThumbnail stores an uploaded thumbnail at key along with its variants.
+func (cfg *apiConfig) storeThumbnail(ctx context.Context, videoID uuid.UUID, key string, data []byte, mediaType string) (database.ThumbnailVariants, error) {
+	tmp, err := os.CreateTemp("", "thumbnail-*"+mediaTypeToExt(mediaType))
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.store.Put(ctx, key, bytes.NewReader(data), mediaType)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.storeThumbnailVariants(ctx, videoID, tmp.Name(), key)
+}
+
+// shareThumbnail makes an already stored thumbnail's variants assets of
+// videoID as well. It returns nil when the thumbnail or its variants aren't
+// stored yet, e.g. while another upload of it is still in flight.
+func (cfg *apiConfig) shareThumbnail(ctx context.Context, videoID uuid.UUID, key string) (database.ThumbnailVariants, error) {
+	if _, err := cfg.store.Stat(ctx, key); err != nil {
+		return nil, nil
+	}
+	variants, err := cfg.thumbnailVariants(key)
+	if err != nil || variants == nil {
+		return nil, err
+	}
+	for _, widths := range variants {
+		for _, k := range widths {
+			err = cfg.db.CreateVideoAsset(videoID, k, database.AssetKindThumbnailVariant)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return variants, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/auth"
+	"github.com/gpr3211/boot-s3-course/internal/media"
+)
+
+func TestHandlerUploadThumbnailBadForm(t *testing.T) {
+	cfg := newTestConfig(t, &media.Fake{})
+	userID := uuid.New()
+	video := createTestVideo(t, cfg, userID)
+	token, err := auth.MakeJWT(userID, cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var large bytes.Buffer
+	form := multipart.NewWriter(&large)
+	part, err := form.CreateFormFile("thumbnail", "thumbnail.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(make([]byte, maxThumbnailUploadSize))
+	form.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantStatus  int
+	}{
+		{"too large", form.FormDataContentType(), large.Bytes(), http.StatusRequestEntityTooLarge},
+		{"not a form", "application/json", []byte(`{"thumbnail": "x"}`), http.StatusBadRequest},
+		{"truncated form", form.FormDataContentType(), large.Bytes()[:1000], http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/api/thumbnail_upload/"+video.ID.String(), bytes.NewReader(tt.body))
+			req.SetPathValue("videoID", video.ID.String())
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadThumbnail(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, strings.TrimSpace(rec.Body.String()))
+			}
+		})
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/auth"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+)
+
+// Resumable video uploads following the tus 1.0.0 protocol (https://tus.io)
+// with the creation, termination and expiration extensions. Upload state lives
+// in the uploads table and the bytes in uploadsDir, so a restart only loses
+// whatever was in flight.
+
+const (
+	tusVersion      = "1.0.0"
+	tusExtensions   = "creation,termination,expiration"
+	tusUploadExpiry = 7 * 24 * time.Hour
+)
+
+// uploadLocks serialises requests per upload so two PATCHes can't interleave.
+// A lock is dropped once nobody holds or waits for it, so finished,
+// terminated and expired uploads leave nothing behind.
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[uuid.UUID]*uploadLock
+}
+
+type uploadLock struct {
+	sync.Mutex
+	// holders and waiters, guarded by uploadLocks.mu
+	refs int
+}
+
+func newUploadLocks() *uploadLocks {
+	return &uploadLocks{locks: map[uuid.UUID]*uploadLock{}}
+}
+
+func (l *uploadLocks) lock(id uuid.UUID) func() {
+	l.mu.Lock()
+	m, ok := l.locks[id]
+	if !ok {
+		m = &uploadLock{}
+		l.locks[id] = m
+	}
+	m.refs++
+	l.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+		l.mu.Lock()
+		m.refs--
+		if m.refs == 0 {
+			delete(l.locks, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+func (cfg *apiConfig) uploadFilePath(id uuid.UUID) string {
+	return filepath.Join(cfg.uploadsDir, id.String())
+}
+
+// uploadVideoPath is where finishUpload moves a fully received upload.
+func (cfg *apiConfig) uploadVideoPath(upload database.Upload) string {
+	return filepath.Join(cfg.uploadsDir, "video-"+upload.ID.String()+mediaTypeToExt(upload.MediaType))
+}
+
+func (cfg *apiConfig) handlerTusOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.Itoa(maxVideoUploadSize))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusCreate(w http.ResponseWriter, r *http.Request) {
+	if !checkTusResumable(w, r) {
+		return
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Length", err)
+		return
+	}
+	if length > maxVideoUploadSize {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Upload is too large", nil)
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata", err)
+		return
+	}
+	videoID, err := uuid.Parse(metadata["video_id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Upload-Metadata must contain a valid video_id", err)
+		return
+	}
+	mediaType := metadata["filetype"]
+	if !cfg.allowedVideoTypes[mediaType] {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Invalid file type", nil)
+		return
+	}
+
+	// digest of the whole upload, checked once it is complete
+	digest, err := parseDigest(r.Header.Get("Repr-Digest"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Repr-Digest", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+		return
+	}
+
+	// unfinished uploads count against the quota, so parallel ones can't
+	// overrun it
+	left, _, err := cfg.storageLeft(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
+		return
+	}
+	if length > left {
+		respondWithUploadError(w, "Couldn't check storage quota", errStorageQuota(left))
+		return
+	}
+
+	upload, err := cfg.db.CreateUpload(database.CreateUploadParams{
+		UserID:         userID,
+		VideoID:        videoID,
+		Length:         length,
+		MediaType:      mediaType,
+		ExpectedSHA256: hex.EncodeToString(digest),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create upload", err)
+		return
+	}
+	f, err := os.Create(cfg.uploadFilePath(upload.ID))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Unable to create file on server", err)
+		return
+	}
+	f.Close()
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Location", "/api/uploads/"+upload.ID.String())
+	w.Header().Set("Upload-Expires", upload.CreatedAt.Add(tusUploadExpiry).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (cfg *apiConfig) handlerTusHead(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getOwnUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.UpdatedAt.Add(tusUploadExpiry).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (cfg *apiConfig) handlerTusPatch(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getOwnUpload(w, r)
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream", nil)
+		return
+	}
+
+	unlock := cfg.uploadLocks.lock(upload.ID)
+	defer unlock()
+	// reload under the lock, another PATCH may have moved the offset
+	upload, err := cfg.db.GetUpload(upload.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return
+	}
+	if upload.CompletedAt != nil {
+		respondWithError(w, http.StatusGone, "Upload already completed", nil)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset", err)
+		return
+	}
+	if offset != upload.Offset {
+		respondWithError(w, http.StatusConflict, "Upload-Offset doesn't match the current offset", nil)
+		return
+	}
+	chunkDigest, err := parseDigest(r.Header.Get("Content-Digest"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid Content-Digest", err)
+		return
+	}
+
+	// a fully received upload whose queueing failed goes straight to finishUpload
+	if upload.Offset < upload.Length {
+		f, err := os.OpenFile(cfg.uploadFilePath(upload.ID), os.O_WRONLY, 0644)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't open upload file", err)
+			return
+		}
+		defer f.Close()
+		// drop bytes written after the last recorded offset, e.g. before a crash
+		if err := f.Truncate(upload.Offset); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't prepare upload file", err)
+			return
+		}
+		if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't prepare upload file", err)
+			return
+		}
+
+		h, err := uploadHash(upload, f.Name())
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't resume upload hash", err)
+			return
+		}
+
+		// keep whatever arrived even if the client drops mid chunk, unless
+		// the chunk has a digest, then it is all or nothing
+		chunk := sha256.New()
+		n, copyErr := io.Copy(io.MultiWriter(f, h, chunk), io.LimitReader(r.Body, upload.Length-upload.Offset))
+		if err := f.Sync(); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save upload chunk", err)
+			return
+		}
+		if chunkDigest != nil {
+			if copyErr != nil {
+				respondWithError(w, http.StatusInternalServerError, "Error saving upload chunk", copyErr)
+				return
+			}
+			// the offset stays put, so the next PATCH truncates the chunk away
+			if err := checkDigest(chunkDigest, chunk.Sum(nil)); err != nil {
+				respondWithUploadError(w, "Couldn't verify upload chunk", err)
+				return
+			}
+		}
+		upload.Offset += n
+		upload.SHA256State, err = h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save upload hash", err)
+			return
+		}
+		if err := cfg.db.UpdateUploadOffset(upload.ID, upload.Offset, upload.SHA256State); err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't save upload offset", err)
+			return
+		}
+		if copyErr != nil {
+			respondWithError(w, http.StatusInternalServerError, "Error saving upload chunk", copyErr)
+			return
+		}
+	}
+
+	if upload.Offset == upload.Length {
+		err := cfg.finishUpload(r.Context(), upload)
+		var rej *uploadRejection
+		if errors.As(err, &rej) {
+			// the content will never be accepted, there's nothing to resume
+			if err := cfg.removeUpload(upload.ID); err != nil {
+				log.Printf("Couldn't remove rejected upload %s: %v", upload.ID, err)
+			}
+			respondWithUploadError(w, "Couldn't validate video", err)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to queue upload %s: %v", upload.ID, err)
+			respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+			return
+		}
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerTusDelete(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getOwnUpload(w, r)
+	if !ok {
+		return
+	}
+
+	unlock := cfg.uploadLocks.lock(upload.ID)
+	defer unlock()
+	if err := cfg.removeUpload(upload.ID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't terminate upload", err)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload validates a fully received upload and hands it to the
+// processing queue. The upload row is kept so HEAD keeps reporting the final
+// offset.
+func (cfg *apiConfig) finishUpload(ctx context.Context, upload database.Upload) error {
+	// move the file out of the way so terminating the upload can't pull it
+	// from under the job
+	src := cfg.uploadFilePath(upload.ID)
+	dst := cfg.uploadVideoPath(upload)
+	path := dst
+	if _, err := os.Stat(dst); os.IsNotExist(err) {
+		path = src
+	}
+	h, err := uploadHash(upload, path)
+	if err != nil {
+		return err
+	}
+	sum := h.Sum(nil)
+	if upload.ExpectedSHA256 != "" {
+		want, err := hex.DecodeString(upload.ExpectedSHA256)
+		if err != nil {
+			return err
+		}
+		if err := checkDigest(want, sum); err != nil {
+			return err
+		}
+	}
+	q, err := cfg.userQuota(upload.UserID)
+	if err != nil {
+		return err
+	}
+	// the job runs on what the file is, not what the client said
+	mediaType, err := cfg.validateVideo(ctx, path, upload.MediaType, q)
+	if err != nil {
+		return err
+	}
+	if path == src {
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+	}
+	if _, err := cfg.enqueueVideoJob(upload.VideoID, dst, mediaType, hex.EncodeToString(sum)); err != nil {
+		return err
+	}
+	return cfg.db.CompleteUpload(upload.ID)
+}
+
+// uploadHash resumes the SHA-256 of the bytes received so far, rehashing them
+// from the file at path for uploads started before the hash state was kept.
+func uploadHash(upload database.Upload, path string) (hash.Hash, error) {
+	h := sha256.New()
+	if upload.SHA256State != nil {
+		err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(upload.SHA256State)
+		return h, err
+	}
+	if upload.Offset == 0 {
+		return h, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.CopyN(h, f, upload.Offset); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// removeUpload deletes an upload and its file. The file finishUpload moved
+// aside is deleted too, unless a job was queued for it, the job owns it then.
+func (cfg *apiConfig) removeUpload(id uuid.UUID) error {
+	upload, err := cfg.db.GetUpload(id)
+	if err != nil {
+		return err
+	}
+	paths := []string{cfg.uploadFilePath(id)}
+	if upload.ID != uuid.Nil && upload.CompletedAt == nil {
+		// queueing failed, or the job was queued but the upload not marked
+		// complete
+		job, err := cfg.db.GetLatestJob(upload.VideoID)
+		if err != nil {
+			return err
+		}
+		if dst := cfg.uploadVideoPath(upload); job.SourcePath != dst {
+			paths = append(paths, dst)
+		}
+	}
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return cfg.db.DeleteUpload(id)
+}
+
+// expireUploads periodically removes unfinished uploads that went quiet.
+func (cfg *apiConfig) expireUploads(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ids, err := cfg.db.GetStaleUploads(time.Now().Add(-tusUploadExpiry))
+		if err != nil {
+			log.Printf("Couldn't load stale uploads: %v", err)
+			continue
+		}
+		for _, id := range ids {
+			unlock := cfg.uploadLocks.lock(id)
+			if err := cfg.removeUpload(id); err != nil {
+				log.Printf("Couldn't remove stale upload %s: %v", id, err)
+			}
+			unlock()
+		}
+	}
+}
+
+// getOwnUpload loads the upload named in the path and checks the caller owns it,
+// responding with an error when it doesn't.
+func (cfg *apiConfig) getOwnUpload(w http.ResponseWriter, r *http.Request) (database.Upload, bool) {
+	if !checkTusResumable(w, r) {
+		return database.Upload{}, false
+	}
+	uploadID, err := uuid.Parse(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Upload{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Upload{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Upload{}, false
+	}
+
+	upload, err := cfg.db.GetUpload(uploadID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get upload", err)
+		return database.Upload{}, false
+	}
+	if upload.ID == uuid.Nil || upload.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Upload not found", nil)
+		return database.Upload{}, false
+	}
+	return upload, true
+}
+
+func checkTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		respondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", nil)
+		return false
+	}
+	return true
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs, the value being optional.
+func parseTusMetadata(header string) (map[string]string, error) {
+	out := map[string]string{}
+	if header == "" {
+		return out, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, fmt.Errorf("malformed metadata pair %q", pair)
+		}
+		value := ""
+		if len(parts) == 2 {
+			dat, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("metadata %s: %w", parts[0], err)
+			}
+			value = string(dat)
+		}
+		out[parts[0]] = value
+	}
+	return out, nil
+}
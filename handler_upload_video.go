@@ -1,17 +1,15 @@
 package main
 
 import (
-	"context"
-	"fmt"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/google/uuid"
 	"github.com/gpr3211/boot-s3-course/internal/auth"
 	"io"
-	"log"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
-	"path/filepath"
 )
 
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
@@ -33,105 +31,163 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
-	fmt.Println(userID)
 
-	const maxMemory = 1 << 30 // 1 GB size limit
-	r.ParseMultipartForm(maxMemory)
-
-	file, header, err := r.FormFile("video")
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
 		return
 	}
-	defer file.Close()
-
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
 		return
 	}
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Invalid file type", nil)
+
+	left, q, err := cfg.storageLeft(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check storage quota", err)
 		return
 	}
-	assetPath := getAssetPath(mediaType)
-	fmt.Println("Asset path is ", assetPath)
 
-	dst, err := os.CreateTemp("", "*"+filepath.Ext(assetPath))
+	// read the form part by part so the file goes to disk once, instead of
+	// being buffered by ParseMultipartForm and then copied again
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoUploadSize)
+	// a request Content-Digest covers the body as sent, multipart encoding
+	// and all, so hash everything read from it
+	bodyDigest, err := parseDigest(r.Header.Get("Content-Digest"))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Unable to create file on server", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid Content-Digest", err)
 		return
 	}
-
-	defer os.Remove(dst.Name())
-	defer dst.Close()
-	// defer is LIFO !!!
-
-	if _, err = io.Copy(dst, file); err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
+	bodyHash := sha256.New()
+	if bodyDigest != nil {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, bodyHash), r.Body}
+	}
+
+	// digests of the video's bytes, from the Repr-Digest header, a
+	// video_digest field before the video or the video part's Content-Digest
+	var digests [][]byte
+	addDigest := func(name, header string) bool {
+		digest, err := parseDigest(header)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid "+name, err)
+			return false
+		}
+		if digest != nil {
+			digests = append(digests, digest)
+		}
+		return true
+	}
+	if !addDigest("Repr-Digest", r.Header.Get("Repr-Digest")) {
 		return
 	}
 
-	ar, err := GetVideoAspectRatio(dst.Name())
+	reader, err := r.MultipartReader()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error getting aspect ratio", err)
+		respondWithError(w, http.StatusBadRequest, "Unable to parse form", err)
 		return
 	}
+	var file *multipart.Part
+	for {
+		file, err = reader.NextPart()
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+			return
+		}
+		if file.FormName() == "video" {
+			break
+		}
+		if file.FormName() == "video_digest" {
+			field, err := io.ReadAll(io.LimitReader(file, maxDigestFieldSize))
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, "Unable to parse form", err)
+				return
+			}
+			if !addDigest("video_digest", string(field)) {
+				return
+			}
+		}
+		file.Close()
+	}
+	defer file.Close()
 
-	processedPath, err := processVideForFastStart(dst.Name())
+	mediaType, _, err := mime.ParseMediaType(file.Header.Get("Content-Type"))
 	if err != nil {
-		log.Printf("Failed to process Video: %v", err)
-		respondWithError(w, http.StatusInternalServerError, "Error processing video", err)
+		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type", err)
 		return
 	}
-	defer os.Remove(processedPath) // Clean up the processed file when done
-
-	// Open the processed file
-	processedFile, err := os.Open(processedPath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error opening processed file", err)
-		fmt.Println("Failed to open file")
+	if !cfg.allowedVideoTypes[mediaType] {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Invalid file type", nil)
 		return
 	}
-	defer processedFile.Close()
-
-	finalPath := SetAspectPrefix(assetPath, ar)
-	fmt.Printf("Final path uploaded to S3: %s\n", finalPath)
-
-	s3Object := s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Body:        processedFile, // Use the file directly instead of bytes buffer
-		Key:         &finalPath,
-		ContentType: &mediaType,
+	if !addDigest("Content-Digest", file.Header.Get("Content-Digest")) {
+		return
 	}
-	putObj, err := cfg.s3Client.PutObject(context.TODO(), &s3Object)
+	// the file has to outlive this request, the processing job picks it up
+	dst, err := os.CreateTemp(cfg.uploadsDir, "video-*"+mediaTypeToExt(mediaType))
 	if err != nil {
-		respondWithError(w, 407, "error uploading to s3", err)
+		respondWithError(w, http.StatusInternalServerError, "Unable to create file on server", err)
+		return
 	}
-	fmt.Println(putObj)
-	// update DB with new video link
+	defer dst.Close()
 
-	video, err := cfg.db.GetVideo(videoID)
+	// hash while saving, the stored video is named after the upload's content
+	h := sha256.New()
+	// left is MaxInt64 without a quota, the body is capped anyway
+	n, err := io.Copy(io.MultiWriter(dst, h), io.LimitReader(file, min(left, maxVideoUploadSize)+1))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't find video", err)
+		os.Remove(dst.Name())
+		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
 		return
 	}
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "Not authorized to update this video", nil)
+	if n > left {
+		os.Remove(dst.Name())
+		respondWithUploadError(w, "Couldn't check storage quota", errStorageQuota(left))
+		return
+	}
+	if err = dst.Close(); err != nil {
+		os.Remove(dst.Name())
+		respondWithError(w, http.StatusInternalServerError, "Error saving file", err)
 		return
 	}
 
-	s3Url := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.s3Bucket, cfg.s3Region, *s3Object.Key)
-	fmt.Printf("S3 video url %s \nUpdating DB video item...\n", s3Url)
-	video.VideoURL = &s3Url
-	err = cfg.db.UpdateVideo(video)
+	sum := h.Sum(nil)
+	for _, digest := range digests {
+		if err = checkDigest(digest, sum); err != nil {
+			os.Remove(dst.Name())
+			respondWithUploadError(w, "Couldn't verify video", err)
+			return
+		}
+	}
+	if bodyDigest != nil {
+		// the rest of the form, up to the closing boundary
+		if _, err = io.Copy(io.Discard, r.Body); err != nil {
+			os.Remove(dst.Name())
+			respondWithError(w, http.StatusBadRequest, "Unable to parse form", err)
+			return
+		}
+		if err = checkDigest(bodyDigest, bodyHash.Sum(nil)); err != nil {
+			os.Remove(dst.Name())
+			respondWithUploadError(w, "Couldn't verify upload", err)
+			return
+		}
+	}
+
+	mediaType, err = cfg.validateVideo(r.Context(), dst.Name(), mediaType, q)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error updating DB video item", err)
+		os.Remove(dst.Name())
+		respondWithUploadError(w, "Couldn't validate video", err)
 		return
 	}
 
-	// next add object to S3 bucket
-	respondWithJSON(w, 200, "success")
+	job, err := cfg.enqueueVideoJob(video.ID, dst.Name(), mediaType, hex.EncodeToString(sum))
+	if err != nil {
+		os.Remove(dst.Name())
+		respondWithError(w, http.StatusInternalServerError, "Couldn't queue video for processing", err)
+		return
+	}
 
-	return
+	respondWithJSON(w, http.StatusAccepted, job)
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/auth"
+	"github.com/gpr3211/boot-s3-course/internal/media"
+)
+
+func sha256Digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+func TestHandlerUploadVideoDigests(t *testing.T) {
+	mp4, err := os.ReadFile(writeMP4(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := sha256Digest([]byte("something else"))
+
+	type upload struct {
+		reprDigest, partDigest, fieldDigest string
+		// the request's Content-Digest, of the body when true
+		bodyDigest, wrongBodyDigest bool
+	}
+	tests := []struct {
+		name       string
+		upload     upload
+		wantStatus int
+	}{
+		{"no digest", upload{}, http.StatusAccepted},
+		{"Repr-Digest", upload{reprDigest: sha256Digest(mp4)}, http.StatusAccepted},
+		{"wrong Repr-Digest", upload{reprDigest: wrong}, http.StatusBadRequest},
+		{"field", upload{fieldDigest: sha256Digest(mp4)}, http.StatusAccepted},
+		{"wrong field", upload{fieldDigest: wrong}, http.StatusBadRequest},
+		{"invalid field", upload{fieldDigest: "sha-256=nope"}, http.StatusBadRequest},
+		{"part Content-Digest", upload{partDigest: sha256Digest(mp4)}, http.StatusAccepted},
+		{"wrong part Content-Digest", upload{partDigest: wrong}, http.StatusBadRequest},
+		{"body Content-Digest", upload{bodyDigest: true}, http.StatusAccepted},
+		{"wrong body Content-Digest", upload{bodyDigest: true, wrongBodyDigest: true}, http.StatusBadRequest},
+		{"all match", upload{reprDigest: sha256Digest(mp4), fieldDigest: sha256Digest(mp4), partDigest: sha256Digest(mp4), bodyDigest: true}, http.StatusAccepted},
+		{"one differs", upload{reprDigest: sha256Digest(mp4), fieldDigest: wrong}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, &media.Fake{Default: &hdProbe})
+			if err := os.MkdirAll(cfg.uploadsDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			userID := uuid.New()
+			video := createTestVideo(t, cfg, userID)
+			token, err := auth.MakeJWT(userID, cfg.jwtSecret, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			if tt.upload.fieldDigest != "" {
+				form.WriteField("video_digest", tt.upload.fieldDigest)
+			}
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Disposition", `form-data; name="video"; filename="upload.mp4"`)
+			header.Set("Content-Type", media.TypeMP4)
+			if tt.upload.partDigest != "" {
+				header.Set("Content-Digest", tt.upload.partDigest)
+			}
+			part, err := form.CreatePart(header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write(mp4)
+			form.Close()
+
+			req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+video.ID.String(), bytes.NewReader(body.Bytes()))
+			req.SetPathValue("videoID", video.ID.String())
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("Content-Type", form.FormDataContentType())
+			if tt.upload.reprDigest != "" {
+				req.Header.Set("Repr-Digest", tt.upload.reprDigest)
+			}
+			if tt.upload.bodyDigest {
+				// a digest of the video alone isn't one of the body
+				digest := sha256Digest(body.Bytes())
+				if tt.upload.wrongBodyDigest {
+					digest = sha256Digest(mp4)
+				}
+				req.Header.Set("Content-Digest", digest)
+			}
+			rec := httptest.NewRecorder()
+			cfg.handlerUploadVideo(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusAccepted {
+				left, err := os.ReadDir(cfg.uploadsDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(left) != 0 {
+					t.Errorf("rejected upload left %d files behind", len(left))
+				}
+			}
+		})
+	}
+}
@@ -2,13 +2,24 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/gpr3211/boot-s3-course/internal/auth"
 	"github.com/gpr3211/boot-s3-course/internal/database"
 )
 
+const (
+	maxTitleLength       = 100  // characters
+	maxDescriptionLength = 5000 // bytes
+)
+
 func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		database.CreateVideoParams
@@ -33,6 +44,17 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	params.UserID = userID
+	err = validateVideoDetails(params.Title, params.Description)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	err = cfg.checkVideoQuota(userID)
+	if err != nil {
+		respondWithUploadError(w, "Couldn't check video quota", err)
+		return
+	}
 
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
 	if err != nil {
@@ -72,11 +94,40 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	keys, err := cfg.videoAssetKeys(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list video assets", err)
+		return
+	}
+	keys, err = cfg.unsharedKeys(video, keys)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't list video assets", err)
+		return
+	}
+	// record the deletions before touching storage so a crash can't leak objects
+	err = cfg.db.EnqueueAssetDeletions(keys)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't schedule asset deletion", err)
+		return
+	}
+
 	err = cfg.db.DeleteVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
 	}
+	cfg.releaseVideoBlobs(video)
+	err = cfg.db.DeleteVideoAssets(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video assets", err)
+		return
+	}
+
+	deletions := make([]database.AssetDeletion, 0, len(keys))
+	for _, key := range keys {
+		deletions = append(deletions, database.AssetDeletion{Key: key})
+	}
+	cfg.deleteAssets(r.Context(), deletions)
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -95,9 +146,160 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// anyone may look a video up, only its owner gets to stream it
+	viewer := uuid.Nil
+	if token, err := auth.GetBearerToken(r.Header); err == nil {
+		if userID, err := auth.ValidateJWT(token, cfg.jwtSecret); err == nil {
+			viewer = userID
+		}
+	}
+	video, err = cfg.signVideo(r.Context(), video, viewer)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+
+	w.Header().Set("ETag", videoETag(video))
 	respondWithJSON(w, http.StatusOK, video)
 }
 
+// handlerVideoMetaUpdate edits the title and description of a video, fields
+// left out of the body are kept. A client sending If-Match with the ETag it
+// got the video with is refused with 412 if the video changed since.
+func (cfg *apiConfig) handlerVideoMetaUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	conditional := r.Header.Get("If-Match") != ""
+	if conditional && !ifMatch(r, videoETag(video)) {
+		w.Header().Set("ETag", videoETag(video))
+		respondWithError(w, http.StatusPreconditionFailed, "Video was changed, fetch it again", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	title, description := video.Title, video.Description
+	if params.Title != nil {
+		title = strings.TrimSpace(*params.Title)
+	}
+	if params.Description != nil {
+		description = *params.Description
+	}
+	err = validateVideoDetails(title, description)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	var version *time.Time
+	if conditional {
+		version = &video.UpdatedAt
+	}
+	ok, err := cfg.db.UpdateVideoDetails(videoID, title, description, version)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	// changed between the check above and the update, or deleted
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	w.Header().Set("ETag", videoETag(video))
+	if !ok {
+		respondWithError(w, http.StatusPreconditionFailed, "Video was changed, fetch it again", nil)
+		return
+	}
+
+	video, err = cfg.signVideo(r.Context(), video, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+func validateVideoDetails(title, description string) error {
+	if strings.TrimSpace(title) == "" {
+		return errors.New("Title is required")
+	}
+	if utf8.RuneCountInString(title) > maxTitleLength {
+		return fmt.Errorf("Title is longer than %d characters", maxTitleLength)
+	}
+	if !utf8.ValidString(title) || !utf8.ValidString(description) {
+		return errors.New("Title and description must be UTF-8")
+	}
+	if len(description) > maxDescriptionLength {
+		return fmt.Errorf("Description is larger than %d bytes", maxDescriptionLength)
+	}
+	return nil
+}
+
+// videoETag names a version of a video, every change bumps updated_at.
+func videoETag(video database.Video) string {
+	return `"` + strconv.FormatInt(video.UpdatedAt.UnixMilli(), 10) + `"`
+}
+
+// ifMatch reports whether If-Match names etag. Only strong tags match.
+func ifMatch(r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerVideosRetrieve lists the user's videos a page at a time, see
+// parseVideosQuery for the options.
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
@@ -110,11 +312,30 @@ func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	params, err := parseVideosQuery(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	params.UserID = userID
+
+	videos, next, err := cfg.db.ListVideos(params)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	for i := range videos {
+		videos[i], err = cfg.signVideo(r.Context(), videos[i], userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+			return
+		}
+	}
+	cursor, err := encodeCursor(next, params.Sort, params.Ascending)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't encode cursor", err)
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, videos)
+	respondWithJSON(w, http.StatusOK, videosPage{Videos: videos, NextCursor: cursor})
 }
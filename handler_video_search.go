@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gpr3211/boot-s3-course/internal/auth"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+)
+
+// searchResult is a video found by a search. The highlights are HTML with
+// the matched words in <mark>, Rank orders the results, lower is better.
+type searchResult struct {
+	database.Video
+	Rank           float64 `json:"rank"`
+	TitleHighlight string  `json:"title_highlight"`
+	Snippet        string  `json:"snippet"`
+}
+
+// handlerVideosSearch finds the user's videos by words of their title or
+// description, ?q= is the text, ?limit= and ?offset= page through the
+// results.
+func (cfg *apiConfig) handlerVideosSearch(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	q := r.URL.Query()
+	text := strings.TrimSpace(q.Get("q"))
+	if text == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing search text", nil)
+		return
+	}
+	limit := defaultVideosPageSize
+	if s := q.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxVideosPageSize {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxVideosPageSize), err)
+			return
+		}
+	}
+	offset := 0
+	if s := q.Get("offset"); s != "" {
+		offset, err = strconv.Atoi(s)
+		if err != nil || offset < 0 {
+			respondWithError(w, http.StatusBadRequest, "offset must be a positive number", err)
+			return
+		}
+	}
+
+	matches, err := cfg.db.SearchVideos(userID, text, limit, offset)
+	if errors.Is(err, database.ErrSearchUnavailable) {
+		respondWithError(w, http.StatusNotImplemented, "Search isn't available on this server", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't search videos", err)
+		return
+	}
+
+	results := make([]searchResult, 0, len(matches))
+	for _, m := range matches {
+		video, err := cfg.signVideo(r.Context(), m.Video, userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't sign video URLs", err)
+			return
+		}
+		results = append(results, searchResult{
+			Video:          video,
+			Rank:           m.Rank,
+			TitleHighlight: markMatches(m.TitleHighlight),
+			Snippet:        markMatches(m.DescriptionMatch),
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, struct {
+		Results []searchResult `json:"results"`
+	}{results})
+}
+
+// markMatches escapes a highlighted text for HTML and marks its matches.
+func markMatches(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, database.HighlightStart, "<mark>")
+	return strings.ReplaceAll(s, database.HighlightEnd, "</mark>")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/auth"
+	"github.com/gpr3211/boot-s3-course/internal/storage"
+)
+
+// streamURLExpiry is how long a signed stream URL plays, long enough to
+// watch and seek through a full length video.
+const streamURLExpiry = 6 * time.Hour
+
+// streamURL is a link to the video's stream endpoint signed for its owner.
+// <video> elements can't send a bearer token, so the signature stands in for
+// it.
+func (cfg *apiConfig) streamURL(videoID uuid.UUID) string {
+	expires := time.Now().Add(streamURLExpiry).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("sig", cfg.streamSignature(videoID, expires))
+	return fmt.Sprintf("/api/videos/%s/stream?%s", videoID, q.Encode())
+}
+
+func (cfg *apiConfig) streamSignature(videoID uuid.UUID, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	fmt.Fprintf(mac, "stream:%s:%d", videoID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validStreamSignature checks the expires and sig query parameters of a
+// stream request.
+func (cfg *apiConfig) validStreamSignature(videoID uuid.UUID, q url.Values) bool {
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	sig, err := hex.DecodeString(q.Get("sig"))
+	if err != nil {
+		return false
+	}
+	want, _ := hex.DecodeString(cfg.streamSignature(videoID, expires))
+	return hmac.Equal(sig, want)
+}
+
+// handlerVideoStream plays the processed video for its owner, either with a
+// bearer token or a signed stream URL. Local storage is served directly with
+// Range support so players can seek; other backends redirect to the object
+// URL, which handles ranges itself.
+func (cfg *apiConfig) handlerVideoStream(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	if !cfg.validStreamSignature(videoID, r.URL.Query()) {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT or stream signature", err)
+			return
+		}
+		userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+		if video.UserID != userID {
+			respondWithError(w, http.StatusForbidden, "You can't view this video", nil)
+			return
+		}
+	}
+
+	key := cfg.storedKey(video.VideoKey, video.VideoURL)
+	if key == "" && video.VideoURL != nil {
+		// uploaded before keys were stored, to a different store
+		http.Redirect(w, r, *video.VideoURL, http.StatusTemporaryRedirect)
+		return
+	}
+	if key == "" {
+		respondWithError(w, http.StatusNotFound, "Video has not been processed yet", nil)
+		return
+	}
+
+	if !cfg.storesLocally() {
+		u, err := cfg.store.URL(r.Context(), key)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't build video URL", err)
+			return
+		}
+		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+		return
+	}
+
+	body, info, err := cfg.store.Get(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		respondWithError(w, http.StatusNotFound, "Video not found", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	defer body.Close()
+	content, ok := body.(io.ReadSeeker)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't seek video", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", info.ContentType)
+	if video.Media != nil && video.Media.SHA256 != "" {
+		// of the whole video, also on partial responses
+		w.Header().Set("Repr-Digest", digestHeader(video.Media.SHA256))
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	// handles Range, If-Range and conditional requests and answers 206/416
+	http.ServeContent(w, r, path.Base(key), info.LastModified, content)
+}
@@ -1,167 +1,136 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os/exec"
-)
 
-type VideoStats struct {
-	Streams []struct {
-		Index              int    `json:"index"`
-		CodecName          string `json:"codec_name,omitempty"`
-		CodecLongName      string `json:"codec_long_name,omitempty"`
-		Profile            string `json:"profile,omitempty"`
-		CodecType          string `json:"codec_type"`
-		CodecTagString     string `json:"codec_tag_string"`
-		CodecTag           string `json:"codec_tag"`
-		Width              int    `json:"width,omitempty"`
-		Height             int    `json:"height,omitempty"`
-		CodedWidth         int    `json:"coded_width,omitempty"`
-		CodedHeight        int    `json:"coded_height,omitempty"`
-		ClosedCaptions     int    `json:"closed_captions,omitempty"`
-		FilmGrain          int    `json:"film_grain,omitempty"`
-		HasBFrames         int    `json:"has_b_frames,omitempty"`
-		SampleAspectRatio  string `json:"sample_aspect_ratio,omitempty"`
-		DisplayAspectRatio string `json:"display_aspect_ratio,omitempty"`
-		PixFmt             string `json:"pix_fmt,omitempty"`
-		Level              int    `json:"level,omitempty"`
-		ColorRange         string `json:"color_range,omitempty"`
-		ColorSpace         string `json:"color_space,omitempty"`
-		ColorTransfer      string `json:"color_transfer,omitempty"`
-		ColorPrimaries     string `json:"color_primaries,omitempty"`
-		ChromaLocation     string `json:"chroma_location,omitempty"`
-		FieldOrder         string `json:"field_order,omitempty"`
-		Refs               int    `json:"refs,omitempty"`
-		IsAvc              string `json:"is_avc,omitempty"`
-		NalLengthSize      string `json:"nal_length_size,omitempty"`
-		ID                 string `json:"id"`
-		RFrameRate         string `json:"r_frame_rate"`
-		AvgFrameRate       string `json:"avg_frame_rate"`
-		TimeBase           string `json:"time_base"`
-		StartPts           int    `json:"start_pts"`
-		StartTime          string `json:"start_time"`
-		DurationTs         int    `json:"duration_ts"`
-		Duration           string `json:"duration"`
-		BitRate            string `json:"bit_rate,omitempty"`
-		BitsPerRawSample   string `json:"bits_per_raw_sample,omitempty"`
-		NbFrames           string `json:"nb_frames"`
-		ExtradataSize      int    `json:"extradata_size"`
-		Disposition        struct {
-			Default         int `json:"default"`
-			Dub             int `json:"dub"`
-			Original        int `json:"original"`
-			Comment         int `json:"comment"`
-			Lyrics          int `json:"lyrics"`
-			Karaoke         int `json:"karaoke"`
-			Forced          int `json:"forced"`
-			HearingImpaired int `json:"hearing_impaired"`
-			VisualImpaired  int `json:"visual_impaired"`
-			CleanEffects    int `json:"clean_effects"`
-			AttachedPic     int `json:"attached_pic"`
-			TimedThumbnails int `json:"timed_thumbnails"`
-			NonDiegetic     int `json:"non_diegetic"`
-			Captions        int `json:"captions"`
-			Descriptions    int `json:"descriptions"`
-			Metadata        int `json:"metadata"`
-			Dependent       int `json:"dependent"`
-			StillImage      int `json:"still_image"`
-		} `json:"disposition"`
-		Tags struct {
-			Language    string `json:"language"`
-			HandlerName string `json:"handler_name"`
-			VendorID    string `json:"vendor_id"`
-			Encoder     string `json:"encoder"`
-			Timecode    string `json:"timecode"`
-		} `json:"tags,omitempty"`
-		SampleFmt      string `json:"sample_fmt,omitempty"`
-		SampleRate     string `json:"sample_rate,omitempty"`
-		Channels       int    `json:"channels,omitempty"`
-		ChannelLayout  string `json:"channel_layout,omitempty"`
-		BitsPerSample  int    `json:"bits_per_sample,omitempty"`
-		InitialPadding int    `json:"initial_padding,omitempty"`
-		Tags0          struct {
-			Language    string `json:"language"`
-			HandlerName string `json:"handler_name"`
-			VendorID    string `json:"vendor_id"`
-		} `json:"tags,omitempty"`
-		Tags1 struct {
-			Language    string `json:"language"`
-			HandlerName string `json:"handler_name"`
-			Timecode    string `json:"timecode"`
-		} `json:"tags,omitempty"`
-	} `json:"streams"`
-}
+	"github.com/gpr3211/boot-s3-course/internal/database"
+	"github.com/gpr3211/boot-s3-course/internal/media"
+)
 
-// gcd greatest common divisor
-func gcd(a, b int) int {
-	for b != 0 {
-		a, b = b, a%b
+// mediaFromProbe summarises a probe for storage. Numbers ffprobe left out
+// stay 0.
+func mediaFromProbe(p media.Probe) database.VideoMedia {
+	m := database.VideoMedia{
+		DurationSeconds: p.Duration(),
+		Container:       p.Format.Name,
+		SizeBytes:       p.Format.Size,
 	}
-	return a
-}
-
-func aspectRatio(width, height int) string {
-	if width <= 0 || height <= 0 {
-		return "Invalid dimensions"
+	if v, err := p.VideoStream(); err == nil {
+		m.Width, m.Height = v.DisplaySize()
+		m.VideoCodec = v.CodecName
+		m.VideoBitrate = v.BitRate
+		m.FrameRate = v.FrameRate
+	}
+	if a, ok := p.AudioStream(); ok {
+		m.AudioCodec = a.CodecName
+		m.AudioBitrate = a.BitRate
+		m.AudioChannels = a.Channels
 	}
-	divisor := gcd(width, height)
-	return fmt.Sprintf("%d:%d", width/divisor, height/divisor)
+	return m
 }
 
-func (v *VideoStats) getRatio() string {
-	out := ""
-	out = aspectRatio(v.Streams[0].Width, v.Streams[0].Height)
-	return out
+// streamingPlan is how a source is turned into the streaming MP4: streams
+// already in H.264/AAC are copied, anything else is re-encoded.
+type streamingPlan struct {
+	video       media.Stream
+	audio       *media.Stream
+	encodeVideo bool
+	encodeAudio bool
+}
 
+func planStreaming(probe media.Probe) (streamingPlan, error) {
+	video, err := probe.VideoStream()
+	if err != nil {
+		return streamingPlan{}, err
+	}
+	plan := streamingPlan{video: video, encodeVideo: video.CodecName != "h264"}
+	if audio, ok := probe.AudioStream(); ok {
+		plan.audio = &audio
+		plan.encodeAudio = audio.CodecName != "aac"
+	}
+	return plan, nil
 }
 
-// getVideoAspectRatio calls ffprobe to get aspect ratio of temp video file before uploading to s3
-// returns a string like 16:9
-func GetVideoAspectRatio(filepath string) (string, error) {
-	v := exec.Command("ffprobe",
-		"-v", "error",
-		"-print_format", "json",
-		"-show_streams",
-		filepath)
+// normalizeForStreaming writes the video as an H.264/AAC fragmented MP4 to
+// ffmpeg's stdout. Fragmented MP4 starts with the moov box, so it plays before
+// it is fully downloaded without the second file -movflags faststart needs.
+// Closing the reader waits for ffmpeg and reports its failure, if any.
+func normalizeForStreaming(ctx context.Context, assetPath string, plan streamingPlan) (io.ReadCloser, error) {
+	args := []string{"-i", assetPath, "-map", fmt.Sprintf("0:%d", plan.video.Index)}
+	if plan.encodeVideo {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "20", "-pix_fmt", "yuv420p")
+	} else {
+		args = append(args, "-c:v", "copy")
+	}
+	if plan.audio != nil {
+		args = append(args, "-map", fmt.Sprintf("0:%d", plan.audio.Index))
+		if plan.encodeAudio {
+			args = append(args, "-c:a", "aac", "-b:a", "128k")
+		} else {
+			args = append(args, "-c:a", "copy")
+		}
+	}
+	args = append(args,
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-f", "mp4",
+		"pipe:1")
 
-	fmt.Printf("Executing command: %v\n", v.String()) // Debug the command
-	out, err := v.Output()
+	v := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	v.Stderr = &stderr
+	out, err := v.StdoutPipe()
 	if err != nil {
-		return "", fmt.Errorf("ffprobe failed: %w", err)
+		return nil, err
+	}
+	if err := v.Start(); err != nil {
+		return nil, err
 	}
+	return &cmdReader{ReadCloser: out, cmd: v, stderr: &stderr}, nil
+}
 
-	fmt.Printf("ffprobe output: %s\n", string(out))
-	data := VideoStats{}
-	err = json.Unmarshal(out, &data)
-	if err != nil {
-		return "", err
+// applyTo updates probed metadata of the source to describe the MP4 the plan
+// produces. Bitrates of re-encoded streams aren't known up front.
+func (p streamingPlan) applyTo(m *database.VideoMedia) {
+	m.Container = "mp4"
+	if p.encodeVideo {
+		m.VideoCodec = "h264"
+		m.VideoBitrate = 0
+	}
+	if p.encodeAudio {
+		m.AudioCodec = "aac"
+		m.AudioBitrate = 0
 	}
-	AR := data.getRatio()
-	fmt.Printf("Video: %s\n Aspect Ratio: %s", filepath, AR)
+}
 
-	return AR, nil
+type cmdReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
 }
-func processVideForFastStart(assetPath string) (string, error) {
-	proc := assetPath + ".processing"
-	v := exec.Command("ffmpeg", "-i", assetPath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", proc)
-	err := v.Run() // Changed from Output() to Run() since we don't need stdout
-	if err != nil {
-		return "", err
+
+func (c *cmdReader) Close() error {
+	c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%w: %s", err, c.stderr.String())
 	}
-	fmt.Printf("Executing command: %v\n", v.String())
-	return proc, nil
+	return nil
 }
 
-func SetAspectPrefix(assetpath, aspect string) string {
-
-	switch aspect {
-	case "16:9":
+// SetAspectPrefix files the asset under its orientation, videos whose shape
+// couldn't be determined go to other/.
+func SetAspectPrefix(assetpath string, orientation media.Orientation) string {
+	switch orientation {
+	case media.OrientationLandscape:
 		return fmt.Sprintf("horizontal/%s", assetpath)
-	case "9:16":
+	case media.OrientationPortrait:
 		return fmt.Sprintf("portrait/%s", assetpath)
+	case media.OrientationSquare:
+		return fmt.Sprintf("square/%s", assetpath)
 	default:
 		return fmt.Sprintf("other/%s", assetpath)
 	}
-
 }
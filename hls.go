@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// packageHLS segments the encoded renditions into outDir without re-encoding:
+// one media playlist and segments per rendition under <index>/ plus
+// master.m3u8 at the top.
+func packageHLS(ctx context.Context, renditions []string, outDir string, withAudio bool) error {
+	args := []string{"-y"}
+	for _, r := range renditions {
+		args = append(args, "-i", r)
+	}
+	streamMap := []string{}
+	for i := range renditions {
+		args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+		entry := fmt.Sprintf("v:%d", i)
+		if withAudio {
+			args = append(args, "-map", fmt.Sprintf("%d:a:0", i))
+			entry += fmt.Sprintf(",a:%d", i)
+		}
+		streamMap = append(streamMap, entry)
+	}
+	args = append(args,
+		"-c", "copy",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outDir, "%v", "segment_%04d.ts"),
+		"-master_pl_name", "master.m3u8",
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(outDir, "%v", "index.m3u8"),
+	)
+	if err := runFFmpeg(ctx, args...); err != nil {
+		return fmt.Errorf("ffmpeg hls failed: %w", err)
+	}
+	return nil
+}
+
+func hlsContentType(name string) string {
+	switch path.Ext(name) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".ts":
+		return "video/mp2t"
+	default:
+		return "application/octet-stream"
+	}
+}
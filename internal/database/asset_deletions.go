@@ -0,0 +1,105 @@
+package database
+
+import (
+	"time"
+)
+
+// AssetDeletion is a stored object that still has to be removed from storage.
+// Rows stay in the table until the delete succeeds so nothing leaks.
+type AssetDeletion struct {
+	Key           string    `json:"key"`
+	CreatedAt     time.Time `json:"created_at"`
+	Attempts      int       `json:"attempts"`
+	LastError     *string   `json:"last_error"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+func (c Client) EnqueueAssetDeletions(keys []string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO asset_deletions (key, created_at, attempts, next_attempt_at)
+	VALUES (?, CURRENT_TIMESTAMP, 0, CURRENT_TIMESTAMP)
+	ON CONFLICT(key) DO NOTHING
+	`
+	for _, key := range keys {
+		if _, err := tx.Exec(query, key); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetDueAssetDeletions returns up to limit pending deletions whose next attempt is due.
+func (c Client) GetDueAssetDeletions(now time.Time, limit int) ([]AssetDeletion, error) {
+	query := `
+	SELECT key, created_at, attempts, last_error, next_attempt_at
+	FROM asset_deletions
+	WHERE next_attempt_at <= ?
+	ORDER BY next_attempt_at
+	LIMIT ?
+	`
+	rows, err := c.db.Query(query, now.UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deletions := []AssetDeletion{}
+	for rows.Next() {
+		var d AssetDeletion
+		if err := rows.Scan(&d.Key, &d.CreatedAt, &d.Attempts, &d.LastError, &d.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		deletions = append(deletions, d)
+	}
+	return deletions, rows.Err()
+}
+
+func (c Client) MarkAssetDeletionFailed(key string, deleteErr error, nextAttemptAt time.Time) error {
+	query := `
+	UPDATE asset_deletions
+	SET attempts = attempts + 1, last_error = ?, next_attempt_at = ?
+	WHERE key = ?
+	`
+	_, err := c.db.Exec(query, deleteErr.Error(), nextAttemptAt.UTC(), key)
+	return err
+}
+
+func (c Client) DeleteAssetDeletion(key string) error {
+	query := `
+	DELETE FROM asset_deletions
+	WHERE key = ?
+	`
+	_, err := c.db.Exec(query, key)
+	return err
+}
+
+// CancelAssetDeletions drops the pending deletions of key and of every key
+// under prefix, for objects that are being stored again. An empty prefix
+// matches nothing.
+func (c Client) CancelAssetDeletions(key, prefix string) error {
+	query := `
+	DELETE FROM asset_deletions
+	WHERE key = ? OR (? != '' AND substr(key, 1, length(?)) = ?)
+	`
+	_, err := c.db.Exec(query, key, prefix, prefix, prefix)
+	return err
+}
+
+// IsAssetReferenced reports whether a video tracks the object at key or it is
+// a blob in use, i.e. whether a queued deletion of it has become stale.
+func (c Client) IsAssetReferenced(key string) (bool, error) {
+	query := `
+	SELECT
+		EXISTS (SELECT 1 FROM video_assets WHERE key = ?) OR
+		EXISTS (SELECT 1 FROM blobs WHERE key = ?)
+	`
+	var referenced bool
+	err := c.db.QueryRow(query, key, key).Scan(&referenced)
+	return referenced, err
+}
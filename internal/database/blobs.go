@@ -0,0 +1,92 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Blob is a content addressed object, stored under a key derived from the
+// SHA-256 of the uploaded content so identical uploads share one object.
+// RefCount is the number of videos using it; objects derived from the blob,
+// e.g. renditions or thumbnail variants, share its lifetime.
+type Blob struct {
+	Key       string    `json:"key"`
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	RefCount  int       `json:"ref_count"`
+	CreatedAt time.Time `json:"created_at"`
+	// total size of the objects derived from the blob
+	DerivedSize int64 `json:"derived_size"`
+}
+
+// AcquireBlob records another reference to the blob at key, creating it on
+// first use, and returns the new reference count.
+func (c Client) AcquireBlob(key, sha256 string, size int64) (int, error) {
+	query := `
+	INSERT INTO blobs (key, sha256, size, ref_count, created_at)
+	VALUES (?, ?, ?, 1, CURRENT_TIMESTAMP)
+	ON CONFLICT(key) DO UPDATE SET ref_count = ref_count + 1
+	RETURNING ref_count
+	`
+	var refs int
+	err := c.db.QueryRow(query, key, sha256, size).Scan(&refs)
+	return refs, err
+}
+
+// ReleaseBlob drops a reference to the blob at key and returns how many are
+// left. The row goes away with the last reference. Keys that aren't content
+// addressed, e.g. of assets stored before deduplication, report 0.
+func (c Client) ReleaseBlob(key string) (int, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE blobs
+	SET ref_count = ref_count - 1
+	WHERE key = ? AND ref_count > 0
+	RETURNING ref_count
+	`
+	var refs int
+	err = tx.QueryRow(query, key).Scan(&refs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if refs == 0 {
+		if _, err := tx.Exec(`DELETE FROM blobs WHERE key = ?`, key); err != nil {
+			return 0, err
+		}
+	}
+	return refs, tx.Commit()
+}
+
+// GetBlob returns the blob at key, or a zero Blob if the key isn't content
+// addressed.
+func (c Client) GetBlob(key string) (Blob, error) {
+	query := `
+	SELECT key, sha256, size, ref_count, created_at, derived_size
+	FROM blobs
+	WHERE key = ?
+	`
+	var blob Blob
+	err := c.db.QueryRow(query, key).Scan(&blob.Key, &blob.SHA256, &blob.Size, &blob.RefCount, &blob.CreatedAt, &blob.DerivedSize)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Blob{}, nil
+		}
+		return Blob{}, err
+	}
+	return blob, nil
+}
+
+// SetBlobDerivedSize records the total size of what is stored under the blob.
+func (c Client) SetBlobDerivedSize(key string, size int64) error {
+	_, err := c.db.Exec(`UPDATE blobs SET derived_size = ? WHERE key = ?`, size, key)
+	return err
+}
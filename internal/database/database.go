@@ -9,6 +9,8 @@ import (
 
 type Client struct {
 	db *sql.DB
+	// whether SQLite has FTS5 for SearchVideos
+	search bool
 }
 
 func NewClient(pathToDB string) (Client, error) {
@@ -16,7 +18,7 @@ func NewClient(pathToDB string) (Client, error) {
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
+	c := Client{db: db}
 	err = c.autoMigrate()
 	if err != nil {
 		return Client{}, err
@@ -72,18 +74,317 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	// storage keys; URLs are built per request so they can be presigned
+	err = c.addColumn("videos", "video_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("videos", "thumbnail_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	// JSON of the resized copies of the thumbnail, see ThumbnailVariants
+	err = c.addColumn("videos", "thumbnail_variants", "TEXT")
+	if err != nil {
+		return err
+	}
+	// manifests of the adaptive bitrate renditions
+	err = c.addColumn("videos", "hls_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("videos", "dash_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	// display shape, also the storage prefix of the video
+	err = c.addColumn("videos", "orientation", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("videos", "aspect_ratio", "TEXT")
+	if err != nil {
+		return err
+	}
+	// MIME type of the upload before it was normalised to MP4
+	err = c.addColumn("videos", "source_media_type", "TEXT")
+	if err != nil {
+		return err
+	}
+	// a user's videos are listed by recency unless asked otherwise
+	_, err = c.db.Exec(`CREATE INDEX IF NOT EXISTS idx_videos_user_id ON videos(user_id, created_at)`)
+	if err != nil {
+		return err
+	}
+
+	// content addressed objects are shared, so an asset can belong to
+	// several videos
+	videoAssetTable := `
+	CREATE TABLE IF NOT EXISTS video_assets (
+		key TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (video_id, key)
+	);
+	`
+	_, err = c.db.Exec(videoAssetTable)
+	if err != nil {
+		return err
+	}
+	err = c.migrateVideoAssetsKey()
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(`CREATE INDEX IF NOT EXISTS idx_video_assets_key ON video_assets(key)`)
+	if err != nil {
+		return err
+	}
+
+	blobTable := `
+	CREATE TABLE IF NOT EXISTS blobs (
+		key TEXT PRIMARY KEY,
+		sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(blobTable)
+	if err != nil {
+		return err
+	}
+	// renditions, candidates, variants and source masters stored under the
+	// blob, counted against the quota of every video using it
+	err = c.addColumn("blobs", "derived_size", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	assetDeletionTable := `
+	CREATE TABLE IF NOT EXISTS asset_deletions (
+		key TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT,
+		next_attempt_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(assetDeletionTable)
+	if err != nil {
+		return err
+	}
+
+	uploadTable := `
+	CREATE TABLE IF NOT EXISTS uploads (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		length INTEGER NOT NULL,
+		upload_offset INTEGER NOT NULL DEFAULT 0,
+		media_type TEXT NOT NULL,
+		completed_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(uploadTable)
+	if err != nil {
+		return err
+	}
+	// serialised SHA-256 of the bytes received so far
+	err = c.addColumn("uploads", "sha256_state", "BLOB")
+	if err != nil {
+		return err
+	}
+	// hex SHA-256 the client announced for the whole upload
+	err = c.addColumn("uploads", "expected_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	jobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		source_path TEXT NOT NULL,
+		media_type TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		run_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status, run_at);
+	CREATE INDEX IF NOT EXISTS idx_jobs_video_id ON jobs(video_id);
+	`
+	_, err = c.db.Exec(jobTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("jobs", "source_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	// reserved against the owner's storage quota until the job is done
+	err = c.addColumn("jobs", "source_size", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+
+	userQuotaTable := `
+	CREATE TABLE IF NOT EXISTS user_quotas (
+		user_id TEXT PRIMARY KEY,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		max_bytes INTEGER,
+		max_videos INTEGER,
+		max_video_duration_seconds REAL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userQuotaTable)
+	if err != nil {
+		return err
+	}
+
+	videoMediaTable := `
+	CREATE TABLE IF NOT EXISTS video_media (
+		video_id TEXT PRIMARY KEY,
+		probed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		duration_seconds REAL NOT NULL,
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		video_codec TEXT NOT NULL,
+		video_bitrate INTEGER NOT NULL,
+		frame_rate REAL NOT NULL,
+		audio_codec TEXT NOT NULL,
+		audio_bitrate INTEGER NOT NULL,
+		audio_channels INTEGER NOT NULL,
+		container TEXT NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_video_media_resolution ON video_media(height, width);
+	`
+	_, err = c.db.Exec(videoMediaTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("video_media", "sha256", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	return c.migrateSearch()
+}
+
+// addColumn adds a column to an existing table unless it is already there,
+// sqlite has no ADD COLUMN IF NOT EXISTS.
+func (c *Client) addColumn(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// migrateVideoAssetsKey rebuilds video_assets tables created when the key
+// alone was the primary key, sqlite can't change a primary key in place.
+func (c *Client) migrateVideoAssetsKey() error {
+	var pk int
+	err := c.db.QueryRow(`SELECT pk FROM pragma_table_info('video_assets') WHERE name = 'video_id'`).Scan(&pk)
+	if err != nil {
+		return err
+	}
+	if pk != 0 {
+		return nil
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	migration := `
+	ALTER TABLE video_assets RENAME TO video_assets_old;
+	DROP INDEX IF EXISTS idx_video_assets_video_id;
+	CREATE TABLE video_assets (
+		key TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (video_id, key)
+	);
+	INSERT INTO video_assets (key, video_id, kind, created_at)
+	SELECT key, video_id, kind, created_at FROM video_assets_old;
+	DROP TABLE video_assets_old;
+	`
+	if _, err := tx.Exec(migration); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (c Client) Reset() error {
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM user_quotas"); err != nil {
+		return fmt.Errorf("failed to reset table user_quotas: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
 	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	if _, err := c.db.Exec("DELETE FROM video_media"); err != nil {
+		return fmt.Errorf("failed to reset table video_media: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM video_assets"); err != nil {
+		return fmt.Errorf("failed to reset table video_assets: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM blobs"); err != nil {
+		return fmt.Errorf("failed to reset table blobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM uploads"); err != nil {
+		return fmt.Errorf("failed to reset table uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM asset_deletions"); err != nil {
+		return fmt.Errorf("failed to reset table asset_deletions: %w", err)
+	}
+	// the index only exists when SQLite has FTS5
+	if c.search {
+		if _, err := c.db.Exec("DELETE FROM videos_fts"); err != nil {
+			return fmt.Errorf("failed to reset table videos_fts: %w", err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,38 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestReset(t *testing.T) {
+	c := newTestClient(t)
+	if _, err := c.CreateVideo(CreateVideoParams{Title: "Kitten video", UserID: uuid.New()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.EnqueueAssetDeletions([]string{"landscape/old.mp4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Reset(); err != nil {
+		t.Fatalf("Reset() error = %v", err)
+	}
+	due, err := c.GetDueAssetDeletions(time.Now().Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(due) != 0 {
+		t.Errorf("%d asset deletions left after Reset()", len(due))
+	}
+	if c.SearchAvailable() {
+		var indexed int
+		if err := c.db.QueryRow("SELECT COUNT(*) FROM videos_fts").Scan(&indexed); err != nil {
+			t.Fatal(err)
+		}
+		if indexed != 0 {
+			t.Errorf("%d videos left in the search index after Reset()", indexed)
+		}
+	}
+}
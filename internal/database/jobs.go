@@ -0,0 +1,184 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Processing job states, in pipeline order.
+const (
+	JobStatusQueued      = "queued"
+	JobStatusProbing     = "probing"
+	JobStatusTranscoding = "transcoding"
+	JobStatusUploading   = "uploading"
+	JobStatusReady       = "ready"
+	JobStatusFailed      = "failed"
+)
+
+// Job is a durable request to run an uploaded file through the video pipeline.
+type Job struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Status    string    `json:"status"`
+	Error     *string   `json:"error"`
+	Attempts  int       `json:"attempts"`
+	CreateJobParams
+}
+
+type CreateJobParams struct {
+	VideoID    uuid.UUID `json:"video_id"`
+	SourcePath string    `json:"-"`
+	MediaType  string    `json:"media_type"`
+	// hex SHA-256 of the source file, empty for jobs queued before hashing
+	SourceSHA256 string `json:"-"`
+	SourceSize   int64  `json:"-"`
+}
+
+const jobColumns = `
+	id,
+	created_at,
+	updated_at,
+	video_id,
+	source_path,
+	media_type,
+	status,
+	error,
+	attempts,
+	COALESCE(source_sha256, ''),
+	source_size
+`
+
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var job Job
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.VideoID,
+		&job.SourcePath,
+		&job.MediaType,
+		&job.Status,
+		&job.Error,
+		&job.Attempts,
+		&job.SourceSHA256,
+		&job.SourceSize,
+	)
+	return job, err
+}
+
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		source_path,
+		media_type,
+		source_sha256,
+		source_size,
+		status,
+		attempts,
+		run_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, 0, ?)
+	`
+	_, err := c.db.Exec(query, id, params.VideoID, params.SourcePath, params.MediaType, params.SourceSHA256, params.SourceSize, JobStatusQueued, time.Now().UTC())
+	if err != nil {
+		return Job{}, err
+	}
+	return c.GetJob(id)
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE id = ?`
+	job, err := scanJob(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// GetLatestJob returns the most recent job for a video, or a zero Job if there is none.
+func (c Client) GetLatestJob(videoID uuid.UUID) (Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE video_id = ? ORDER BY created_at DESC, rowid DESC LIMIT 1`
+	job, err := scanJob(c.db.QueryRow(query, videoID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// ClaimJob atomically moves the oldest due queued job to probing and returns it.
+// ok is false when nothing is due.
+func (c Client) ClaimJob() (job Job, ok bool, err error) {
+	query := `
+	UPDATE jobs
+	SET status = ?, attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM jobs
+		WHERE status = ? AND run_at <= ?
+		ORDER BY run_at, rowid
+		LIMIT 1
+	)
+	RETURNING ` + jobColumns
+	job, err = scanJob(c.db.QueryRow(query, JobStatusProbing, JobStatusQueued, time.Now().UTC()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, false, nil
+		}
+		return Job{}, false, err
+	}
+	return job, true, nil
+}
+
+func (c Client) UpdateJobStatus(id uuid.UUID, status string, jobErr error) error {
+	var errMsg *string
+	if jobErr != nil {
+		msg := jobErr.Error()
+		errMsg = &msg
+	}
+	query := `
+	UPDATE jobs
+	SET status = ?, error = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, errMsg, id)
+	return err
+}
+
+// RetryJob puts a failed job back in the queue, to be picked up after runAt.
+func (c Client) RetryJob(id uuid.UUID, jobErr error, runAt time.Time) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, error = ?, run_at = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, JobStatusQueued, jobErr.Error(), runAt.UTC(), id)
+	return err
+}
+
+// RequeueRunningJobs puts jobs that were in flight when the server stopped
+// back in the queue.
+func (c Client) RequeueRunningJobs() (int64, error) {
+	query := `
+	UPDATE jobs
+	SET status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE status IN (?, ?, ?)
+	`
+	res, err := c.db.Exec(query, JobStatusQueued, JobStatusProbing, JobStatusTranscoding, JobStatusUploading)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserQuota is an admin's override of the default quotas for one user, nil
+// fields keep the default.
+type UserQuota struct {
+	UserID                  uuid.UUID `json:"user_id"`
+	UpdatedAt               time.Time `json:"updated_at"`
+	MaxBytes                *int64    `json:"max_bytes"`
+	MaxVideos               *int      `json:"max_videos"`
+	MaxVideoDurationSeconds *float64  `json:"max_video_duration_seconds"`
+}
+
+// UserUsage is what a user currently takes up.
+type UserUsage struct {
+	Videos int `json:"videos"`
+	// everything stored for the user's videos: processed videos, renditions,
+	// thumbnail candidates, source masters and thumbnails with their variants
+	Bytes int64 `json:"bytes"`
+	// announced length of unfinished resumable uploads and the sources of
+	// videos still waiting to be processed
+	ReservedBytes int64 `json:"reserved_bytes"`
+}
+
+// GetUserQuota returns the user's overrides, or a zero UserQuota if there are none.
+func (c Client) GetUserQuota(userID uuid.UUID) (UserQuota, error) {
+	query := `
+	SELECT user_id, updated_at, max_bytes, max_videos, max_video_duration_seconds
+	FROM user_quotas
+	WHERE user_id = ?
+	`
+	var q UserQuota
+	err := c.db.QueryRow(query, userID).Scan(&q.UserID, &q.UpdatedAt, &q.MaxBytes, &q.MaxVideos, &q.MaxVideoDurationSeconds)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserQuota{}, nil
+		}
+		return UserQuota{}, err
+	}
+	return q, nil
+}
+
+func (c Client) UpsertUserQuota(q UserQuota) error {
+	query := `
+	INSERT INTO user_quotas (user_id, updated_at, max_bytes, max_videos, max_video_duration_seconds)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		updated_at = excluded.updated_at,
+		max_bytes = excluded.max_bytes,
+		max_videos = excluded.max_videos,
+		max_video_duration_seconds = excluded.max_video_duration_seconds
+	`
+	_, err := c.db.Exec(query, q.UserID, q.MaxBytes, q.MaxVideos, q.MaxVideoDurationSeconds)
+	return err
+}
+
+func (c Client) GetUserUsage(userID uuid.UUID) (UserUsage, error) {
+	query := `
+	SELECT
+		COUNT(*),
+		COALESCE(SUM(m.size_bytes), 0) +
+		COALESCE(SUM(bv.derived_size), 0) +
+		COALESCE(SUM(bt.size), 0) +
+		COALESCE(SUM(bt.derived_size), 0)
+	FROM videos v
+	LEFT JOIN video_media m ON m.video_id = v.id
+	LEFT JOIN blobs bv ON bv.key = v.video_key
+	LEFT JOIN blobs bt ON bt.key = v.thumbnail_key
+	WHERE v.user_id = ?
+	`
+	var usage UserUsage
+	err := c.db.QueryRow(query, userID).Scan(&usage.Videos, &usage.Bytes)
+	if err != nil {
+		return UserUsage{}, err
+	}
+
+	query = `
+	SELECT
+		(
+			SELECT COALESCE(SUM(length), 0)
+			FROM uploads
+			WHERE user_id = ? AND completed_at IS NULL
+		) + (
+			SELECT COALESCE(SUM(j.source_size), 0)
+			FROM jobs j
+			JOIN videos v ON v.id = j.video_id
+			WHERE v.user_id = ? AND j.status NOT IN (?, ?)
+		)
+	`
+	err = c.db.QueryRow(query, userID, userID, JobStatusReady, JobStatusFailed).Scan(&usage.ReservedBytes)
+	if err != nil {
+		return UserUsage{}, err
+	}
+	return usage, nil
+}
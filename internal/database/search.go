@@ -0,0 +1,199 @@
+package database
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// Snippets mark matched terms with these, so callers can escape the text
+// before turning them into markup.
+const (
+	HighlightStart = "\x02"
+	HighlightEnd   = "\x03"
+)
+
+// ErrSearchUnavailable is returned by SearchVideos when SQLite was built
+// without FTS5, see migrateSearch.
+var ErrSearchUnavailable = errors.New("full-text search needs SQLite built with FTS5 (-tags sqlite_fts5)")
+
+// VideoMatch is a video found by SearchVideos. Rank is the bm25 score, lower
+// is better.
+type VideoMatch struct {
+	Video
+	Rank             float64
+	TitleHighlight   string
+	DescriptionMatch string
+}
+
+// migrateSearch creates the full-text index of video titles and
+// descriptions. Its rows carry the ID of their video, not its rowid, which
+// VACUUM may renumber. Triggers keep it in sync with the videos table, so
+// every write through CreateVideo, UpdateVideoDetails, DeleteVideo or Reset
+// updates it in the same statement. mattn/go-sqlite3 only includes FTS5 when
+// built with the sqlite_fts5 tag, without it the server still runs and search
+// is turned off.
+func (c *Client) migrateSearch() error {
+	var available bool
+	err := c.db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&available)
+	if err != nil {
+		return err
+	}
+	dropTriggers := `
+	DROP TRIGGER IF EXISTS videos_fts_insert;
+	DROP TRIGGER IF EXISTS videos_fts_update;
+	DROP TRIGGER IF EXISTS videos_fts_delete;
+	`
+	if !available {
+		log.Printf("Video search is disabled: %v", ErrSearchUnavailable)
+		// an index made by an FTS5 build can't be written to, stop
+		// maintaining it so videos can still be saved
+		_, err = c.db.Exec(dropTriggers)
+		return err
+	}
+
+	// an index keyed by the videos' rowids is rebuilt with their IDs
+	var columns, keyedByID int
+	err = c.db.QueryRow(`
+	SELECT COUNT(*), COUNT(*) FILTER (WHERE name = 'video_id')
+	FROM pragma_table_info('videos_fts')
+	`).Scan(&columns, &keyedByID)
+	if err != nil {
+		return err
+	}
+	if columns > 0 && keyedByID == 0 {
+		_, err = c.db.Exec(dropTriggers + `DROP TABLE videos_fts;`)
+		if err != nil {
+			return err
+		}
+	}
+
+	// without the triggers the index is new or missed writes
+	var synced int
+	err = c.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'videos_fts_insert'`).Scan(&synced)
+	if err != nil {
+		return err
+	}
+
+	searchTable := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS videos_fts USING fts5(
+		video_id UNINDEXED,
+		title,
+		description,
+		tokenize = 'unicode61 remove_diacritics 2'
+	);
+	CREATE TRIGGER IF NOT EXISTS videos_fts_insert AFTER INSERT ON videos BEGIN
+		INSERT INTO videos_fts (video_id, title, description)
+		VALUES (new.id, new.title, COALESCE(new.description, ''));
+	END;
+	CREATE TRIGGER IF NOT EXISTS videos_fts_update AFTER UPDATE OF title, description ON videos BEGIN
+		UPDATE videos_fts
+		SET title = new.title, description = COALESCE(new.description, '')
+		WHERE video_id = old.id;
+	END;
+	CREATE TRIGGER IF NOT EXISTS videos_fts_delete AFTER DELETE ON videos BEGIN
+		DELETE FROM videos_fts WHERE video_id = old.id;
+	END;
+	`
+	_, err = c.db.Exec(searchTable)
+	if err != nil {
+		return err
+	}
+	c.search = true
+
+	if synced == 0 {
+		_, err = c.db.Exec(`
+		DELETE FROM videos_fts;
+		INSERT INTO videos_fts (video_id, title, description)
+		SELECT id, title, COALESCE(description, '') FROM videos;
+		`)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchAvailable reports whether SQLite was built with FTS5, see
+// migrateSearch.
+func (c Client) SearchAvailable() bool {
+	return c.search
+}
+
+// SearchVideos returns the user's videos containing every word of text, each
+// also as the prefix of a longer word, best matches first. Matches in the
+// title weigh more than in the description.
+func (c Client) SearchVideos(userID uuid.UUID, text string, limit, offset int) ([]VideoMatch, error) {
+	if !c.search {
+		return nil, ErrSearchUnavailable
+	}
+	matches := []VideoMatch{}
+	match := searchQuery(text)
+	if match == "" {
+		return matches, nil
+	}
+
+	query := `
+	SELECT` + videoColumns + `,
+		bm25(videos_fts, 0, 10, 1),
+		highlight(videos_fts, 1, ?, ?),
+		snippet(videos_fts, 2, ?, ?, '…', 24)
+	FROM videos_fts f
+	JOIN videos v ON v.id = f.video_id
+	WHERE videos_fts MATCH ? AND v.user_id = ?
+	ORDER BY bm25(videos_fts, 0, 10, 1), v.created_at DESC
+	LIMIT ? OFFSET ?
+	`
+	rows, err := c.db.Query(query,
+		HighlightStart, HighlightEnd,
+		HighlightStart, HighlightEnd,
+		match, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m VideoMatch
+		m.Video, err = scanVideo(rows, &m.Rank, &m.TitleHighlight, &m.DescriptionMatch)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uuid.UUID, len(matches))
+	for i := range matches {
+		ids[i] = matches[i].ID
+	}
+	media, err := c.getVideosMedia(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range matches {
+		matches[i].Media = media[matches[i].ID]
+	}
+	return matches, nil
+}
+
+// searchQuery turns what a user typed into an FTS5 query of prefix terms.
+// Words are quoted so nothing typed is taken as query syntax.
+func searchQuery(text string) string {
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = `"` + word + `"*`
+	}
+	return strings.Join(terms, " ")
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSearchVideos(t *testing.T) {
+	c := newTestClient(t)
+	if _, err := c.SearchVideos(uuid.New(), "x", 10, 0); errors.Is(err, ErrSearchUnavailable) {
+		t.Skip("SQLite built without FTS5, run with -tags sqlite_fts5")
+	}
+	userID := uuid.New()
+
+	ids := map[string]uuid.UUID{}
+	for _, v := range []CreateVideoParams{
+		{Title: "Gone soon", Description: "deleted before the vacuum"},
+		{Title: "Kitten video", Description: "a cat plays"},
+		{Title: "Puppy party", Description: "dogs and a kitten"},
+		{Title: "Kitchen tour", Description: "cooking"},
+	} {
+		v.UserID = userID
+		video, err := c.CreateVideo(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[v.Title] = video.ID
+	}
+	if _, err := c.CreateVideo(CreateVideoParams{Title: "Kitten of someone else", UserID: uuid.New()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteVideo(ids["Gone soon"]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UpdateVideoDetails(ids["Kitchen tour"], "Kite flying", "windy", nil); err != nil {
+		t.Fatal(err)
+	}
+	// VACUUM may renumber the rowids of videos, it has no INTEGER PRIMARY KEY
+	if _, err := c.db.Exec(`VACUUM; UPDATE videos SET rowid = rowid + 1000`); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"kitten", []string{"Kitten video", "Puppy party"}},
+		{"kit", []string{"Kitten video", "Kitchen tour", "Puppy party"}},
+		{"windy", []string{"Kitchen tour"}},
+		{"cooking", nil},
+		{"deleted", nil},
+		{"\"; DROP", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			matches, err := c.SearchVideos(userID, tt.text, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(matches) != len(tt.want) {
+				t.Fatalf("SearchVideos(%q) found %d videos, want %d", tt.text, len(matches), len(tt.want))
+			}
+			found := map[uuid.UUID]VideoMatch{}
+			for _, m := range matches {
+				found[m.ID] = m
+			}
+			for _, title := range tt.want {
+				m, ok := found[ids[title]]
+				if !ok {
+					t.Errorf("SearchVideos(%q) didn't find %q", tt.text, title)
+					continue
+				}
+				// the highlight is of the video's own title
+				if stripMarks(m.TitleHighlight) != m.Title {
+					t.Errorf("highlight %q is of another title than %q", m.TitleHighlight, m.Title)
+				}
+			}
+		})
+	}
+}
+
+func stripMarks(s string) string {
+	out := []rune{}
+	for _, r := range s {
+		if string(r) != HighlightStart && string(r) != HighlightEnd {
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,37 @@
+package database
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+// ThumbnailVariants maps an image format ("webp", "jpeg") and width in
+// pixels to a resized copy of the thumbnail: storage keys in the database,
+// URLs in API responses.
+type ThumbnailVariants map[string]map[int]string
+
+func (v ThumbnailVariants) Value() (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(dat), nil
+}
+
+func (v *ThumbnailVariants) Scan(src any) error {
+	switch src := src.(type) {
+	case nil:
+		*v = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(src), v)
+	case []byte:
+		return json.Unmarshal(src, v)
+	default:
+		return fmt.Errorf("can't scan %T into ThumbnailVariants", src)
+	}
+}
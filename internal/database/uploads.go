@@ -0,0 +1,136 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload is the persisted state of a resumable (tus) upload.
+type Upload struct {
+	ID          uuid.UUID  `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Offset      int64      `json:"offset"`
+	CompletedAt *time.Time `json:"completed_at"`
+	// SHA256State is the marshalled hash of the first Offset bytes
+	SHA256State []byte `json:"-"`
+	CreateUploadParams
+}
+
+type CreateUploadParams struct {
+	UserID    uuid.UUID `json:"user_id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	Length    int64     `json:"length"`
+	MediaType string    `json:"media_type"`
+	// hex SHA-256 the finished upload must match, empty if the client sent none
+	ExpectedSHA256 string `json:"-"`
+}
+
+func (c Client) CreateUpload(params CreateUploadParams) (Upload, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO uploads (
+		id,
+		created_at,
+		updated_at,
+		user_id,
+		video_id,
+		length,
+		upload_offset,
+		media_type,
+		expected_sha256
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, 0, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, params.UserID, params.VideoID, params.Length, params.MediaType, params.ExpectedSHA256)
+	if err != nil {
+		return Upload{}, err
+	}
+	return c.GetUpload(id)
+}
+
+func (c Client) GetUpload(id uuid.UUID) (Upload, error) {
+	query := `
+	SELECT id, created_at, updated_at, user_id, video_id, length, upload_offset, media_type, completed_at, sha256_state, COALESCE(expected_sha256, '')
+	FROM uploads
+	WHERE id = ?
+	`
+	var upload Upload
+	err := c.db.QueryRow(query, id).Scan(
+		&upload.ID,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+		&upload.UserID,
+		&upload.VideoID,
+		&upload.Length,
+		&upload.Offset,
+		&upload.MediaType,
+		&upload.CompletedAt,
+		&upload.SHA256State,
+		&upload.ExpectedSHA256,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Upload{}, nil
+		}
+		return Upload{}, err
+	}
+	return upload, nil
+}
+
+// UpdateUploadOffset records how much of the upload has been received along
+// with the hash state of those bytes.
+func (c Client) UpdateUploadOffset(id uuid.UUID, offset int64, sha256State []byte) error {
+	query := `
+	UPDATE uploads
+	SET upload_offset = ?, sha256_state = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, offset, sha256State, id)
+	return err
+}
+
+func (c Client) CompleteUpload(id uuid.UUID) error {
+	query := `
+	UPDATE uploads
+	SET completed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+func (c Client) DeleteUpload(id uuid.UUID) error {
+	query := `
+	DELETE FROM uploads
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, id)
+	return err
+}
+
+// GetStaleUploads returns unfinished uploads that haven't been touched since before.
+func (c Client) GetStaleUploads(before time.Time) ([]uuid.UUID, error) {
+	query := `
+	SELECT id
+	FROM uploads
+	WHERE completed_at IS NULL AND updated_at < ?
+	`
+	rows, err := c.db.Query(query, before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,216 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	AssetKindVideo     = "video"
+	AssetKindThumbnail = "thumbnail"
+	AssetKindHLS       = "hls"
+	AssetKindDASH      = "dash"
+	// frames extracted from the video the owner can pick a thumbnail from
+	AssetKindThumbnailCandidate = "thumbnail_candidate"
+	// the upload as received, kept when source masters are enabled
+	AssetKindSource = "source"
+	// resized copies of a thumbnail or thumbnail candidate
+	AssetKindThumbnailVariant = "thumbnail_variant"
+)
+
+// VideoAsset is a stored object that belongs to a video.
+type VideoAsset struct {
+	Key       string    `json:"key"`
+	VideoID   uuid.UUID `json:"video_id"`
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateVideoAsset tracks the object at key for the video. Content addressed
+// keys come back when the same content is stored again, so a deletion still
+// queued for key is cancelled.
+func (c Client) CreateVideoAsset(videoID uuid.UUID, key, kind string) error {
+	query := `
+	INSERT INTO video_assets (key, video_id, kind, created_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(video_id, key) DO UPDATE SET kind = excluded.kind;
+	DELETE FROM asset_deletions WHERE key = ?;
+	`
+	_, err := c.db.Exec(query, key, videoID, kind, key)
+	return err
+}
+
+// CopyVideoAssetsWithPrefix makes the assets of one video under prefix assets
+// of another as well, for videos sharing a content addressed blob. Like
+// CreateVideoAsset it cancels queued deletions of the copied keys.
+func (c Client) CopyVideoAssetsWithPrefix(fromVideoID, toVideoID uuid.UUID, prefix string) error {
+	query := `
+	INSERT INTO video_assets (key, video_id, kind, created_at)
+	SELECT key, ?, kind, CURRENT_TIMESTAMP
+	FROM video_assets
+	WHERE video_id = ? AND substr(key, 1, length(?)) = ?
+	ON CONFLICT(video_id, key) DO UPDATE SET kind = excluded.kind;
+	DELETE FROM asset_deletions
+	WHERE key IN (
+		SELECT key FROM video_assets
+		WHERE video_id = ? AND substr(key, 1, length(?)) = ?
+	);
+	`
+	_, err := c.db.Exec(query, toVideoID, fromVideoID, prefix, prefix, toVideoID, prefix, prefix)
+	return err
+}
+
+func (c Client) GetVideoAssets(videoID uuid.UUID) ([]VideoAsset, error) {
+	query := `
+	SELECT key, video_id, kind, created_at
+	FROM video_assets
+	WHERE video_id = ?
+	`
+	rows, err := c.db.Query(query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := []VideoAsset{}
+	for rows.Next() {
+		var asset VideoAsset
+		if err := rows.Scan(&asset.Key, &asset.VideoID, &asset.Kind, &asset.CreatedAt); err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+	return assets, rows.Err()
+}
+
+// GetVideoAssetsByKind returns the video's assets of one kind ordered by key.
+func (c Client) GetVideoAssetsByKind(videoID uuid.UUID, kind string) ([]VideoAsset, error) {
+	query := `
+	SELECT key, video_id, kind, created_at
+	FROM video_assets
+	WHERE video_id = ? AND kind = ?
+	ORDER BY key
+	`
+	rows, err := c.db.Query(query, videoID, kind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := []VideoAsset{}
+	for rows.Next() {
+		var asset VideoAsset
+		if err := rows.Scan(&asset.Key, &asset.VideoID, &asset.Kind, &asset.CreatedAt); err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+	return assets, rows.Err()
+}
+
+// GetVideoAssetsWithPrefix returns every asset whose key starts with prefix.
+// Shared keys are listed once per video using them.
+func (c Client) GetVideoAssetsWithPrefix(prefix string) ([]VideoAsset, error) {
+	query := `
+	SELECT key, video_id, kind, created_at
+	FROM video_assets
+	WHERE substr(key, 1, length(?)) = ?
+	ORDER BY key
+	`
+	rows, err := c.db.Query(query, prefix, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	assets := []VideoAsset{}
+	for rows.Next() {
+		var asset VideoAsset
+		if err := rows.Scan(&asset.Key, &asset.VideoID, &asset.Kind, &asset.CreatedAt); err != nil {
+			return nil, err
+		}
+		assets = append(assets, asset)
+	}
+	return assets, rows.Err()
+}
+
+func (c Client) DeleteVideoAssets(videoID uuid.UUID) error {
+	query := `
+	DELETE FROM video_assets
+	WHERE video_id = ?
+	`
+	_, err := c.db.Exec(query, videoID)
+	return err
+}
+
+func (c Client) DeleteVideoAsset(videoID uuid.UUID, key string) error {
+	query := `
+	DELETE FROM video_assets
+	WHERE video_id = ? AND key = ?
+	`
+	_, err := c.db.Exec(query, videoID, key)
+	return err
+}
+
+// DeleteVideoAssetsWithPrefix stops tracking every asset of the video whose key
+// starts with prefix.
+func (c Client) DeleteVideoAssetsWithPrefix(videoID uuid.UUID, prefix string) error {
+	query := `
+	DELETE FROM video_assets
+	WHERE video_id = ? AND substr(key, 1, length(?)) = ?
+	`
+	_, err := c.db.Exec(query, videoID, prefix, prefix)
+	return err
+}
+
+// GetReferencedAssets returns every asset key tracked for a video, the keys on
+// videos and the raw URLs of legacy rows, i.e. everything storage must keep.
+func (c Client) GetReferencedAssets() (keys []string, urls []string, err error) {
+	rows, err := c.db.Query(`SELECT DISTINCT key FROM video_assets`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	urlRows, err := c.db.Query(`SELECT thumbnail_key, video_key, hls_key, dash_key, thumbnail_url, video_url FROM videos`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer urlRows.Close()
+	for urlRows.Next() {
+		var thumbnailKey, videoKey, hlsKey, dashKey, thumbnailURL, videoURL *string
+		if err := urlRows.Scan(&thumbnailKey, &videoKey, &hlsKey, &dashKey, &thumbnailURL, &videoURL); err != nil {
+			return nil, nil, err
+		}
+		if thumbnailKey != nil {
+			keys = append(keys, *thumbnailKey)
+		}
+		if videoKey != nil {
+			keys = append(keys, *videoKey)
+		}
+		if hlsKey != nil {
+			keys = append(keys, *hlsKey)
+		}
+		if dashKey != nil {
+			keys = append(keys, *dashKey)
+		}
+		if thumbnailURL != nil {
+			urls = append(urls, *thumbnailURL)
+		}
+		if videoURL != nil {
+			urls = append(urls, *videoURL)
+		}
+	}
+	return keys, urls, urlRows.Err()
+}
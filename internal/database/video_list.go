@@ -0,0 +1,160 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoSort is a field videos can be listed by.
+type VideoSort string
+
+const (
+	VideoSortCreated  VideoSort = "created"
+	VideoSortUpdated  VideoSort = "updated"
+	VideoSortTitle    VideoSort = "title"
+	VideoSortDuration VideoSort = "duration"
+)
+
+// sortExpr is what each sort orders by. Timestamps are normalised since rows
+// written by SQLite and by Go store them in different formats, videos that
+// weren't processed yet have no duration and sort as 0.
+var sortExpr = map[VideoSort]string{
+	VideoSortCreated:  `strftime('%Y-%m-%d %H:%M:%f', v.created_at)`,
+	VideoSortUpdated:  `strftime('%Y-%m-%d %H:%M:%f', v.updated_at)`,
+	VideoSortTitle:    `v.title COLLATE NOCASE`,
+	VideoSortDuration: `COALESCE(m.duration_seconds, 0)`,
+}
+
+// Valid reports whether videos can be listed by s.
+func (s VideoSort) Valid() bool {
+	_, ok := sortExpr[s]
+	return ok
+}
+
+// VideoCursor is the position after the last video of a page: its value of
+// the sort field, a string or a float64 for duration, and its ID to break
+// ties.
+type VideoCursor struct {
+	Value any       `json:"v"`
+	ID    uuid.UUID `json:"id"`
+}
+
+// ListVideosParams selects a page of a user's videos. Nil filters match
+// every video, CreatedFrom is inclusive and CreatedTo exclusive.
+type ListVideosParams struct {
+	UserID       uuid.UUID
+	Sort         VideoSort
+	Ascending    bool
+	Limit        int
+	After        *VideoCursor
+	HasVideo     *bool
+	HasThumbnail *bool
+	Orientation  string
+	CreatedFrom  *time.Time
+	CreatedTo    *time.Time
+}
+
+// ListVideos returns up to params.Limit videos and the cursor of the next
+// page, nil if this is the last one.
+func (c Client) ListVideos(params ListVideosParams) ([]Video, *VideoCursor, error) {
+	expr, ok := sortExpr[params.Sort]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown sort %q", params.Sort)
+	}
+	dir, cmp := "DESC", "<"
+	if params.Ascending {
+		dir, cmp = "ASC", ">"
+	}
+
+	where := []string{"v.user_id = ?"}
+	args := []any{params.UserID}
+	if params.HasVideo != nil {
+		where = append(where, present("v.video_key", "v.video_url", *params.HasVideo))
+	}
+	if params.HasThumbnail != nil {
+		where = append(where, present("v.thumbnail_key", "v.thumbnail_url", *params.HasThumbnail))
+	}
+	if params.Orientation != "" {
+		where = append(where, "v.orientation = ?")
+		args = append(args, params.Orientation)
+	}
+	if params.CreatedFrom != nil {
+		where = append(where, "strftime('%Y-%m-%d %H:%M:%f', v.created_at) >= strftime('%Y-%m-%d %H:%M:%f', ?)")
+		args = append(args, params.CreatedFrom.UTC())
+	}
+	if params.CreatedTo != nil {
+		where = append(where, "strftime('%Y-%m-%d %H:%M:%f', v.created_at) < strftime('%Y-%m-%d %H:%M:%f', ?)")
+		args = append(args, params.CreatedTo.UTC())
+	}
+	if params.After != nil {
+		where = append(where, fmt.Sprintf("(%s, v.id) %s (?, ?)", expr, cmp))
+		args = append(args, params.After.Value, params.After.ID)
+	}
+
+	// one more than asked for tells whether there is a next page
+	query := `
+	SELECT` + videoColumns + `,
+		` + expr + `
+	FROM videos v
+	LEFT JOIN video_media m ON m.video_id = v.id
+	WHERE ` + strings.Join(where, " AND ") + `
+	ORDER BY ` + expr + ` ` + dir + `, v.id ` + dir + `
+	LIMIT ?
+	`
+	args = append(args, params.Limit+1)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	videos := []Video{}
+	var last any
+	var next *VideoCursor
+	for rows.Next() {
+		var value any
+		video, err := scanVideo(rows, &value)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(videos) == params.Limit {
+			next = &VideoCursor{Value: last, ID: videos[len(videos)-1].ID}
+			break
+		}
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		last = value
+		videos = append(videos, video)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]uuid.UUID, len(videos))
+	for i := range videos {
+		ids[i] = videos[i].ID
+	}
+	media, err := c.getVideosMedia(ids)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range videos {
+		videos[i].Media = media[videos[i].ID]
+	}
+	return videos, next, nil
+}
+
+// present is the condition of either column being set, or neither if want is
+// false. Videos from before storage keys only have a URL.
+func present(keyColumn, urlColumn string, want bool) string {
+	cond := fmt.Sprintf("(%s IS NOT NULL OR %s IS NOT NULL)", keyColumn, urlColumn)
+	if !want {
+		cond = "NOT " + cond
+	}
+	return cond
+}
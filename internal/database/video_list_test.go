@@ -0,0 +1,172 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+	c, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.db.Close() })
+	return c
+}
+
+// listAll pages through the listing limit videos at a time.
+func listAll(t *testing.T, c Client, params ListVideosParams, limit int) []Video {
+	t.Helper()
+	params.Limit = limit
+	var all []Video
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("listing doesn't end")
+		}
+		videos, next, err := c.ListVideos(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(videos) > limit {
+			t.Fatalf("page has %d videos, limit is %d", len(videos), limit)
+		}
+		all = append(all, videos...)
+		if next == nil {
+			return all
+		}
+		if len(videos) != limit {
+			t.Fatalf("short page of %d videos has a next cursor", len(videos))
+		}
+		params.After = next
+	}
+}
+
+// ms truncates t to the precision videos are sorted by.
+func ms(t time.Time) time.Time {
+	return t.Truncate(time.Millisecond)
+}
+
+func TestListVideosPaging(t *testing.T) {
+	c := newTestClient(t)
+	userID := uuid.New()
+	other := uuid.New()
+
+	titles := []string{"delta", "Alpha", "charlie", "echo", "bravo", "alpha", "Foxtrot"}
+	durations := map[string]float64{"delta": 30, "echo": 5.5, "bravo": 30, "Foxtrot": 120}
+	for _, title := range titles {
+		video, err := c.CreateVideo(CreateVideoParams{Title: title, UserID: userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, ok := durations[title]; ok {
+			if err := c.UpsertVideoMedia(video.ID, VideoMedia{DurationSeconds: d}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := c.CreateVideo(CreateVideoParams{Title: "someone else's", UserID: other}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sort      VideoSort
+		ascending bool
+		less      func(a, b Video) bool
+	}{
+		{VideoSortCreated, false, func(a, b Video) bool { return ms(a.CreatedAt).After(ms(b.CreatedAt)) }},
+		{VideoSortCreated, true, func(a, b Video) bool { return ms(a.CreatedAt).Before(ms(b.CreatedAt)) }},
+		{VideoSortTitle, true, func(a, b Video) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) }},
+		{VideoSortTitle, false, func(a, b Video) bool { return strings.ToLower(a.Title) > strings.ToLower(b.Title) }},
+		{VideoSortDuration, false, func(a, b Video) bool { return durations[a.Title] > durations[b.Title] }},
+		{VideoSortDuration, true, func(a, b Video) bool { return durations[a.Title] < durations[b.Title] }},
+	}
+	for _, tt := range tests {
+		for _, limit := range []int{1, 2, 3, 7, 10} {
+			t.Run(fmt.Sprintf("%s asc=%v limit=%d", tt.sort, tt.ascending, limit), func(t *testing.T) {
+				got := listAll(t, c, ListVideosParams{UserID: userID, Sort: tt.sort, Ascending: tt.ascending}, limit)
+				if len(got) != len(titles) {
+					t.Fatalf("listed %d videos, want %d", len(got), len(titles))
+				}
+				seen := map[uuid.UUID]bool{}
+				for _, v := range got {
+					if seen[v.ID] {
+						t.Fatalf("video %q listed twice", v.Title)
+					}
+					seen[v.ID] = true
+					if v.UserID != userID {
+						t.Fatalf("listed video %q of another user", v.Title)
+					}
+				}
+				if !sort.SliceIsSorted(got, func(i, j int) bool { return tt.less(got[i], got[j]) }) {
+					var order []string
+					for _, v := range got {
+						order = append(order, v.Title)
+					}
+					t.Errorf("listed out of order: %v", order)
+				}
+			})
+		}
+	}
+}
+
+func TestListVideosFilters(t *testing.T) {
+	c := newTestClient(t)
+	userID := uuid.New()
+
+	var portrait Video
+	for i := 0; i < 4; i++ {
+		video, err := c.CreateVideo(CreateVideoParams{Title: fmt.Sprintf("video %d", i), UserID: userID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			portrait = video
+		}
+	}
+	key := "portrait/abc.mp4"
+	orientation := "portrait"
+	portrait.VideoKey = &key
+	portrait.Orientation = &orientation
+	if err := c.UpdateVideo(portrait); err != nil {
+		t.Fatal(err)
+	}
+
+	yes, no := true, false
+	tests := []struct {
+		name   string
+		params ListVideosParams
+		want   int
+	}{
+		{"all", ListVideosParams{}, 4},
+		{"with video", ListVideosParams{HasVideo: &yes}, 1},
+		{"without video", ListVideosParams{HasVideo: &no}, 3},
+		{"without thumbnail", ListVideosParams{HasThumbnail: &no}, 4},
+		{"portrait", ListVideosParams{Orientation: "portrait"}, 1},
+		{"landscape", ListVideosParams{Orientation: "landscape"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.params.UserID = userID
+			tt.params.Sort = VideoSortCreated
+			got := listAll(t, c, tt.params, 2)
+			if len(got) != tt.want {
+				t.Errorf("listed %d videos, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestListVideosUnknownSort(t *testing.T) {
+	c := newTestClient(t)
+	_, _, err := c.ListVideos(ListVideosParams{UserID: uuid.New(), Sort: "views; DROP TABLE videos", Limit: 10})
+	if err == nil {
+		t.Fatal("ListVideos() with an unknown sort succeeded")
+	}
+}
@@ -0,0 +1,161 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoMedia is what ffprobe found in a processed video. Audio fields are
+// empty for silent videos.
+type VideoMedia struct {
+	ProbedAt        time.Time `json:"probed_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Width           int       `json:"width"`
+	Height          int       `json:"height"`
+	VideoCodec      string    `json:"video_codec"`
+	VideoBitrate    int64     `json:"video_bitrate"`
+	FrameRate       float64   `json:"frame_rate"`
+	AudioCodec      string    `json:"audio_codec"`
+	AudioBitrate    int64     `json:"audio_bitrate"`
+	AudioChannels   int       `json:"audio_channels"`
+	Container       string    `json:"container"`
+	SizeBytes       int64     `json:"size_bytes"`
+	// hex SHA-256 of the processed MP4, to verify downloads against
+	SHA256 string `json:"sha256"`
+}
+
+const videoMediaColumns = `
+		probed_at,
+		duration_seconds,
+		width,
+		height,
+		video_codec,
+		video_bitrate,
+		frame_rate,
+		audio_codec,
+		audio_bitrate,
+		audio_channels,
+		container,
+		size_bytes,
+		sha256`
+
+// scanVideoMedia reads videoMediaColumns followed by any extra columns.
+func scanVideoMedia(row interface{ Scan(...any) error }, extra ...any) (VideoMedia, error) {
+	var m VideoMedia
+	dest := append([]any{
+		&m.ProbedAt,
+		&m.DurationSeconds,
+		&m.Width,
+		&m.Height,
+		&m.VideoCodec,
+		&m.VideoBitrate,
+		&m.FrameRate,
+		&m.AudioCodec,
+		&m.AudioBitrate,
+		&m.AudioChannels,
+		&m.Container,
+		&m.SizeBytes,
+		&m.SHA256,
+	}, extra...)
+	err := row.Scan(dest...)
+	return m, err
+}
+
+// UpsertVideoMedia replaces the probe results of a video.
+func (c Client) UpsertVideoMedia(videoID uuid.UUID, m VideoMedia) error {
+	query := `
+	INSERT INTO video_media (
+		video_id,` + videoMediaColumns + `
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(video_id) DO UPDATE SET
+		probed_at = excluded.probed_at,
+		duration_seconds = excluded.duration_seconds,
+		width = excluded.width,
+		height = excluded.height,
+		video_codec = excluded.video_codec,
+		video_bitrate = excluded.video_bitrate,
+		frame_rate = excluded.frame_rate,
+		audio_codec = excluded.audio_codec,
+		audio_bitrate = excluded.audio_bitrate,
+		audio_channels = excluded.audio_channels,
+		container = excluded.container,
+		size_bytes = excluded.size_bytes,
+		sha256 = excluded.sha256
+	`
+	_, err := c.db.Exec(query,
+		videoID,
+		m.DurationSeconds,
+		m.Width,
+		m.Height,
+		m.VideoCodec,
+		m.VideoBitrate,
+		m.FrameRate,
+		m.AudioCodec,
+		m.AudioBitrate,
+		m.AudioChannels,
+		m.Container,
+		m.SizeBytes,
+		m.SHA256,
+	)
+	return err
+}
+
+// GetVideoMedia returns nil if the video hasn't been processed yet.
+func (c Client) GetVideoMedia(videoID uuid.UUID) (*VideoMedia, error) {
+	query := `
+	SELECT` + videoMediaColumns + `
+	FROM video_media
+	WHERE video_id = ?
+	`
+	m, err := scanVideoMedia(c.db.QueryRow(query, videoID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
+// getVideosMedia returns the probe results of the processed videos among
+// ids by video ID.
+func (c Client) getVideosMedia(ids []uuid.UUID) (map[uuid.UUID]*VideoMedia, error) {
+	media := map[uuid.UUID]*VideoMedia{}
+	if len(ids) == 0 {
+		return media, nil
+	}
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	query := `
+	SELECT` + videoMediaColumns + `,
+		video_id
+	FROM video_media
+	WHERE video_id IN (?` + strings.Repeat(", ?", len(ids)-1) + `)
+	`
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var videoID uuid.UUID
+		m, err := scanVideoMedia(rows, &videoID)
+		if err != nil {
+			return nil, err
+		}
+		media[videoID] = &m
+	}
+	return media, rows.Err()
+}
+
+func (c Client) deleteVideoMedia(videoID uuid.UUID) error {
+	_, err := c.db.Exec(`DELETE FROM video_media WHERE video_id = ?`, videoID)
+	return err
+}
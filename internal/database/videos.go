@@ -9,11 +9,24 @@ import (
 )
 
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID                   uuid.UUID         `json:"id"`
+	CreatedAt            time.Time         `json:"created_at"`
+	UpdatedAt            time.Time         `json:"updated_at"`
+	ThumbnailURL         *string           `json:"thumbnail_url"`
+	ThumbnailVariants    ThumbnailVariants `json:"thumbnail_variants"`
+	VideoURL             *string           `json:"video_url"`
+	StreamURL            *string           `json:"stream_url"`
+	HLSURL               *string           `json:"hls_url"`
+	DASHURL              *string           `json:"dash_url"`
+	Orientation          *string           `json:"orientation"`
+	AspectRatio          *string           `json:"aspect_ratio"`
+	SourceMediaType      *string           `json:"source_media_type"`
+	ThumbnailKey         *string           `json:"-"`
+	ThumbnailVariantKeys ThumbnailVariants `json:"-"`
+	VideoKey             *string           `json:"-"`
+	HLSKey               *string           `json:"-"`
+	DASHKey              *string           `json:"-"`
+	Media                *VideoMedia       `json:"media"`
 	CreateVideoParams
 }
 
@@ -23,47 +36,47 @@ type CreateVideoParams struct {
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
-
-	rows, err := c.db.Query(query, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	videos := []Video{}
-	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
-			return nil, err
-		}
-		videos = append(videos, video)
-	}
-
-	return videos, nil
+const videoColumns = `
+		v.id,
+		v.created_at,
+		v.updated_at,
+		v.title,
+		v.description,
+		v.thumbnail_url,
+		v.video_url,
+		v.thumbnail_key,
+		v.thumbnail_variants,
+		v.video_key,
+		v.hls_key,
+		v.dash_key,
+		v.orientation,
+		v.aspect_ratio,
+		v.source_media_type,
+		v.user_id`
+
+// scanVideo reads videoColumns followed by any extra columns.
+func scanVideo(row interface{ Scan(...any) error }, extra ...any) (Video, error) {
+	var video Video
+	dest := append([]any{
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.ThumbnailKey,
+		&video.ThumbnailVariantKeys,
+		&video.VideoKey,
+		&video.HLSKey,
+		&video.DASHKey,
+		&video.Orientation,
+		&video.AspectRatio,
+		&video.SourceMediaType,
+		&video.UserID,
+	}, extra...)
+	err := row.Scan(dest...)
+	return video, err
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
@@ -88,29 +101,12 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
-	FROM videos
-	WHERE id = ?
+	SELECT` + videoColumns + `
+	FROM videos v
+	WHERE v.id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -118,34 +114,107 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 		return Video{}, err
 	}
 
+	video.Media, err = c.GetVideoMedia(id)
+	if err != nil {
+		return Video{}, err
+	}
 	return video, nil
 }
 
+// GetVideoIDWithKey returns a video other than except whose processed video
+// is stored at key, or uuid.Nil if there is none.
+func (c Client) GetVideoIDWithKey(key string, except uuid.UUID) (uuid.UUID, error) {
+	query := `
+	SELECT id
+	FROM videos
+	WHERE video_key = ? AND id != ?
+	ORDER BY created_at
+	LIMIT 1
+	`
+	var id uuid.UUID
+	err := c.db.QueryRow(query, key, except).Scan(&id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, nil
+		}
+		return uuid.Nil, err
+	}
+	return id, nil
+}
+
+// UpdateVideo saves everything about a video but its title and description,
+// those only change through UpdateVideoDetails so a long running upload can't
+// undo an edit made meanwhile.
 func (c Client) UpdateVideo(video Video) error {
 	query := `
 	UPDATE videos
 	SET
-		title = ?,
-		description = ?,
+		updated_at = ?,
 		thumbnail_url = ?,
 		video_url = ?,
+		thumbnail_key = ?,
+		thumbnail_variants = ?,
+		video_key = ?,
+		hls_key = ?,
+		dash_key = ?,
+		orientation = ?,
+		aspect_ratio = ?,
+		source_media_type = ?,
 		user_id = ?
 	WHERE id = ?
 	`
 
 	_, err := c.db.Exec(
 		query,
-		video.Title,
-		video.Description,
+		modifiedNow(),
 		&video.ThumbnailURL,
 		&video.VideoURL,
+		video.ThumbnailKey,
+		video.ThumbnailVariantKeys,
+		video.VideoKey,
+		video.HLSKey,
+		video.DASHKey,
+		video.Orientation,
+		video.AspectRatio,
+		video.SourceMediaType,
 		video.UserID,
 		video.ID,
 	)
 	return err
 }
 
+// UpdateVideoDetails changes the title and description of a video. With
+// ifUpdatedAt set it only does so if the video is still at that version, ok
+// reports whether the video was updated.
+func (c Client) UpdateVideoDetails(id uuid.UUID, title, description string, ifUpdatedAt *time.Time) (ok bool, err error) {
+	// compared at the millisecond precision updated_at is written with,
+	// whatever format the row stores it in
+	query := `
+	UPDATE videos
+	SET title = ?, description = ?, updated_at = ?
+	WHERE id = ? AND (
+		? IS NULL OR
+		strftime('%Y-%m-%d %H:%M:%f', updated_at) = strftime('%Y-%m-%d %H:%M:%f', ?)
+	)
+	`
+	res, err := c.db.Exec(query, title, description, modifiedNow(), id, ifUpdatedAt, ifUpdatedAt)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// modifiedNow is the updated_at of a change made now. Millisecond precision
+// keeps versions distinct while still comparable in SQL.
+func modifiedNow() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	if err := c.deleteVideoMedia(id); err != nil {
+		return err
+	}
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
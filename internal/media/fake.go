@@ -0,0 +1,32 @@
+package media
+
+import (
+	"context"
+	"fmt"
+)
+
+// Fake is a Prober that returns canned results, so code probing videos can be
+// tested without ffprobe installed.
+type Fake struct {
+	// Probes by path; Default is returned for paths not listed.
+	Probes  map[string]Probe
+	Default *Probe
+	// Err, if set, is returned for every probe.
+	Err error
+}
+
+func (f *Fake) Probe(ctx context.Context, path string) (Probe, error) {
+	if err := ctx.Err(); err != nil {
+		return Probe{}, err
+	}
+	if f.Err != nil {
+		return Probe{}, f.Err
+	}
+	if p, ok := f.Probes[path]; ok {
+		return p, nil
+	}
+	if f.Default != nil {
+		return *f.Default, nil
+	}
+	return Probe{}, fmt.Errorf("fake probe: no result for %s", path)
+}
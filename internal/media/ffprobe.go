@@ -0,0 +1,164 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FFprobe probes files with the ffprobe binary.
+type FFprobe struct {
+	// Path of the binary, "ffprobe" on $PATH when empty.
+	Path string
+	// Timeout bounds a single probe on top of the caller's context; 0 means
+	// no extra limit.
+	Timeout time.Duration
+}
+
+func NewFFprobe(timeout time.Duration) *FFprobe {
+	return &FFprobe{Timeout: timeout}
+}
+
+// ffprobeOutput mirrors the parts of `ffprobe -print_format json
+// -show_format -show_streams` we read. ffprobe prints most numbers as
+// strings.
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		Size       string `json:"size"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+	Streams []struct {
+		Index             int    `json:"index"`
+		CodecName         string `json:"codec_name"`
+		CodecType         string `json:"codec_type"`
+		Width             int    `json:"width"`
+		Height            int    `json:"height"`
+		SampleAspectRatio string `json:"sample_aspect_ratio"`
+		RFrameRate        string `json:"r_frame_rate"`
+		AvgFrameRate      string `json:"avg_frame_rate"`
+		Duration          string `json:"duration"`
+		BitRate           string `json:"bit_rate"`
+		SampleRate        string `json:"sample_rate"`
+		Channels          int    `json:"channels"`
+		Tags              struct {
+			// set by older muxers instead of a display matrix
+			Rotate string `json:"rotate"`
+		} `json:"tags"`
+		SideDataList []struct {
+			SideDataType string  `json:"side_data_type"`
+			Rotation     float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+}
+
+func (f *FFprobe) Probe(ctx context.Context, path string) (Probe, error) {
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+	bin := f.Path
+	if bin == "" {
+		bin = "ffprobe"
+	}
+
+	cmd := exec.CommandContext(ctx, bin,
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return Probe{}, fmt.Errorf("ffprobe %s: %w", path, ctx.Err())
+		}
+		return Probe{}, fmt.Errorf("ffprobe %s: %w: %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var raw ffprobeOutput
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return Probe{}, fmt.Errorf("couldn't parse ffprobe output: %w", err)
+	}
+
+	p := Probe{
+		Format: Format{
+			Name:     raw.Format.FormatName,
+			Duration: parseFloat(raw.Format.Duration),
+			Size:     parseInt(raw.Format.Size),
+			BitRate:  parseInt(raw.Format.BitRate),
+		},
+	}
+	for _, s := range raw.Streams {
+		stream := Stream{
+			Index:             s.Index,
+			CodecType:         s.CodecType,
+			CodecName:         s.CodecName,
+			Duration:          parseFloat(s.Duration),
+			BitRate:           parseInt(s.BitRate),
+			Width:             s.Width,
+			Height:            s.Height,
+			SampleAspectRatio: s.SampleAspectRatio,
+			Channels:          s.Channels,
+			SampleRate:        int(parseInt(s.SampleRate)),
+		}
+		stream.FrameRate = parseRational(s.AvgFrameRate)
+		if stream.FrameRate == 0 {
+			stream.FrameRate = parseRational(s.RFrameRate)
+		}
+
+		rotation := parseFloat(s.Tags.Rotate)
+		for _, sd := range s.SideDataList {
+			if sd.SideDataType == "Display Matrix" {
+				// the display matrix is counter-clockwise, rotate tags are clockwise
+				rotation = -sd.Rotation
+			}
+		}
+		stream.Rotation = normalizeRotation(rotation)
+
+		p.Streams = append(p.Streams, stream)
+	}
+	return p, nil
+}
+
+// normalizeRotation snaps a rotation in degrees to 0, 90, 180 or 270.
+func normalizeRotation(deg float64) int {
+	r := int(math.Round(deg/90)) * 90
+	return ((r % 360) + 360) % 360
+}
+
+func parseFloat(s string) float64 {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
+
+func parseInt(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
+
+// parseRational reads ffprobe's rational numbers like "30000/1001".
+func parseRational(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		return parseFloat(s)
+	}
+	d := parseFloat(den)
+	if d == 0 {
+		return 0
+	}
+	return parseFloat(num) / d
+}
@@ -0,0 +1,196 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubFFprobe is an FFprobe running a script that prints output, or fails
+// with it on stderr when exitCode isn't 0.
+func stubFFprobe(t *testing.T, output string, exitCode int) *FFprobe {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	if err := os.WriteFile(out, []byte(output), 0644); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\ncat '" + out + "'\n"
+	if exitCode != 0 {
+		script = "#!/bin/sh\ncat '" + out + "' >&2\nexit 1\n"
+	}
+	bin := filepath.Join(dir, "ffprobe")
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return &FFprobe{Path: bin}
+}
+
+const phoneProbe = `{
+	"streams": [
+		{
+			"index": 0,
+			"codec_name": "h264",
+			"codec_type": "video",
+			"width": 1920,
+			"height": 1080,
+			"sample_aspect_ratio": "1:1",
+			"r_frame_rate": "30/1",
+			"avg_frame_rate": "30000/1001",
+			"duration": "12.345000",
+			"bit_rate": "8000000",
+			"side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]
+		},
+		{
+			"index": 1,
+			"codec_name": "aac",
+			"codec_type": "audio",
+			"sample_rate": "48000",
+			"channels": 2,
+			"bit_rate": "128000"
+		},
+		{
+			"index": 2,
+			"codec_name": "mjpeg",
+			"codec_type": "video",
+			"width": 300,
+			"height": 300
+		}
+	],
+	"format": {
+		"format_name": "mov,mp4,m4a,3gp,3g2,mj2",
+		"duration": "12.400000",
+		"size": "12400000",
+		"bit_rate": "8000000"
+	}
+}`
+
+func TestFFprobeProbe(t *testing.T) {
+	p, err := stubFFprobe(t, phoneProbe, 0).Probe(context.Background(), "video.mp4")
+	if err != nil {
+		t.Fatalf("Probe() error = %v", err)
+	}
+
+	if p.Format.Name != "mov,mp4,m4a,3gp,3g2,mj2" || p.Format.Size != 12400000 || p.Format.BitRate != 8000000 {
+		t.Errorf("Format = %+v", p.Format)
+	}
+	if p.Duration() != 12.4 {
+		t.Errorf("Duration() = %v, want 12.4", p.Duration())
+	}
+	if len(p.Streams) != 3 {
+		t.Fatalf("%d streams, want 3", len(p.Streams))
+	}
+
+	video, err := p.VideoStream()
+	if err != nil {
+		t.Fatalf("VideoStream() error = %v", err)
+	}
+	if video.Index != 0 || video.CodecName != "h264" || video.Width != 1920 || video.Height != 1080 {
+		t.Errorf("VideoStream() = %+v", video)
+	}
+	// avg_frame_rate wins over r_frame_rate
+	if video.FrameRate < 29.97 || video.FrameRate > 29.98 {
+		t.Errorf("FrameRate = %v, want 29.97", video.FrameRate)
+	}
+	// the display matrix turns counter-clockwise
+	if video.Rotation != 90 {
+		t.Errorf("Rotation = %d, want 90", video.Rotation)
+	}
+	if w, h := video.DisplaySize(); w != 1080 || h != 1920 {
+		t.Errorf("DisplaySize() = %dx%d, want 1080x1920", w, h)
+	}
+
+	audio, ok := p.AudioStream()
+	if !ok || audio.CodecName != "aac" || audio.SampleRate != 48000 || audio.Channels != 2 || audio.BitRate != 128000 {
+		t.Errorf("AudioStream() = %+v, %v", audio, ok)
+	}
+}
+
+func TestFFprobeProbeFallbacks(t *testing.T) {
+	output := `{
+		"streams": [
+			{"index": 0, "codec_name": "png", "codec_type": "video", "width": 64, "height": 64},
+			{"index": 1, "codec_name": "vp9", "codec_type": "video", "width": 640, "height": 480,
+			 "r_frame_rate": "25/1", "avg_frame_rate": "0/0", "duration": "3.5", "tags": {"rotate": "-90"}}
+		],
+		"format": {"format_name": "matroska,webm", "duration": "N/A", "size": "1000"}
+	}`
+	p, err := stubFFprobe(t, output, 0).Probe(context.Background(), "video.webm")
+	if err != nil {
+		t.Fatalf("Probe() error = %v", err)
+	}
+	video, err := p.VideoStream()
+	if err != nil {
+		t.Fatalf("VideoStream() error = %v", err)
+	}
+	if video.CodecName != "vp9" {
+		t.Errorf("VideoStream() = %s, want the stream after the cover art", video.CodecName)
+	}
+	if video.FrameRate != 25 {
+		t.Errorf("FrameRate = %v, want r_frame_rate 25", video.FrameRate)
+	}
+	if video.Rotation != 270 {
+		t.Errorf("Rotation = %d, want 270", video.Rotation)
+	}
+	if p.Duration() != 3.5 {
+		t.Errorf("Duration() = %v, want the video stream's 3.5", p.Duration())
+	}
+	if _, ok := p.AudioStream(); ok {
+		t.Error("AudioStream() found a stream in a silent video")
+	}
+}
+
+func TestFFprobeProbeErrors(t *testing.T) {
+	t.Run("no video stream", func(t *testing.T) {
+		p, err := stubFFprobe(t, `{"streams": [{"codec_type": "audio", "codec_name": "mp3"}], "format": {}}`, 0).Probe(context.Background(), "song.mp3")
+		if err != nil {
+			t.Fatalf("Probe() error = %v", err)
+		}
+		if _, err := p.VideoStream(); !errors.Is(err, ErrNoVideoStream) {
+			t.Errorf("VideoStream() error = %v, want %v", err, ErrNoVideoStream)
+		}
+	})
+	t.Run("ffprobe fails", func(t *testing.T) {
+		_, err := stubFFprobe(t, "video.mp4: Invalid data found when processing input", 1).Probe(context.Background(), "video.mp4")
+		if err == nil || !strings.Contains(err.Error(), "Invalid data found") {
+			t.Errorf("Probe() error = %v, want ffprobe's message", err)
+		}
+	})
+	t.Run("bad output", func(t *testing.T) {
+		_, err := stubFFprobe(t, "not json", 0).Probe(context.Background(), "video.mp4")
+		if err == nil {
+			t.Error("Probe() parsed output that isn't JSON")
+		}
+	})
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := stubFFprobe(t, phoneProbe, 0).Probe(ctx, "video.mp4")
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Probe() error = %v, want %v", err, context.Canceled)
+		}
+	})
+	t.Run("missing binary", func(t *testing.T) {
+		f := &FFprobe{Path: filepath.Join(t.TempDir(), "no-ffprobe"), Timeout: time.Second}
+		if _, err := f.Probe(context.Background(), "video.mp4"); err == nil {
+			t.Error("Probe() succeeded without ffprobe")
+		}
+	})
+}
+
+func TestNormalizeRotation(t *testing.T) {
+	tests := map[float64]int{0: 0, 90: 90, -90: 270, 180: 180, -180: 180, 270: 270, 360: 0, 450: 90, 89.6: 90, -269.9: 90}
+	for deg, want := range tests {
+		if got := normalizeRotation(deg); got != want {
+			t.Errorf("normalizeRotation(%v) = %d, want %d", deg, got, want)
+		}
+	}
+}
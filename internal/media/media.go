@@ -0,0 +1,99 @@
+// Package media inspects video files.
+package media
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrNoVideoStream = errors.New("no video stream")
+
+// Prober reads the container and stream metadata of a media file.
+type Prober interface {
+	Probe(ctx context.Context, path string) (Probe, error)
+}
+
+// Probe is the metadata of one media file.
+type Probe struct {
+	Format  Format
+	Streams []Stream
+}
+
+// Format describes the container.
+type Format struct {
+	Name     string  // e.g. "mov,mp4,m4a,3gp,3g2,mj2"
+	Duration float64 // seconds, 0 if unknown
+	Size     int64   // bytes
+	BitRate  int64   // bit/s
+}
+
+// Stream describes one elementary stream. Numbers the container doesn't
+// carry are 0.
+type Stream struct {
+	Index     int
+	CodecType string // "video", "audio", "subtitle", "data"
+	CodecName string
+	Duration  float64
+	BitRate   int64
+
+	// video only
+	Width             int
+	Height            int
+	SampleAspectRatio string  // "1:1" for square pixels, empty if unknown
+	FrameRate         float64 // frames per second
+	Rotation          int     // clockwise display rotation: 0, 90, 180 or 270
+
+	// audio only
+	Channels   int
+	SampleRate int
+}
+
+// VideoStream returns the first video stream. Cover art and other still
+// images attached to the file are skipped.
+func (p Probe) VideoStream() (Stream, error) {
+	for _, s := range p.Streams {
+		if s.CodecType == "video" && !isStillImage(s.CodecName) {
+			return s, nil
+		}
+	}
+	return Stream{}, ErrNoVideoStream
+}
+
+// AudioStream returns the first audio stream.
+func (p Probe) AudioStream() (Stream, bool) {
+	for _, s := range p.Streams {
+		if s.CodecType == "audio" {
+			return s, true
+		}
+	}
+	return Stream{}, false
+}
+
+// Duration is the container duration, falling back to the video stream's.
+func (p Probe) Duration() float64 {
+	if p.Format.Duration > 0 {
+		return p.Format.Duration
+	}
+	if v, err := p.VideoStream(); err == nil {
+		return v.Duration
+	}
+	return 0
+}
+
+// DisplaySize is the size the stream is shown at: coded dimensions with the
+// width and height swapped when the player rotates it by 90 or 270 degrees.
+// Non-square pixels are not accounted for, see DisplayAspect.
+func (s Stream) DisplaySize() (width, height int) {
+	if s.Rotation == 90 || s.Rotation == 270 {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
+
+func isStillImage(codec string) bool {
+	switch codec {
+	case "mjpeg", "png", "bmp", "gif", "webp":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package media
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+type Orientation string
+
+const (
+	OrientationLandscape Orientation = "landscape"
+	OrientationPortrait  Orientation = "portrait"
+	OrientationSquare    Orientation = "square"
+)
+
+// squareTolerance is how far, relative to 1:1, a display aspect may be and
+// still count as square.
+const squareTolerance = 0.05
+
+// standardRatios are the aspect ratios shapes are snapped to.
+var standardRatios = []struct {
+	Name  string
+	Value float64
+}{
+	{"21:9", 21.0 / 9},
+	{"16:9", 16.0 / 9},
+	{"3:2", 3.0 / 2},
+	{"4:3", 4.0 / 3},
+	{"5:4", 5.0 / 4},
+	{"1:1", 1},
+	{"4:5", 4.0 / 5},
+	{"3:4", 3.0 / 4},
+	{"2:3", 2.0 / 3},
+	{"9:16", 9.0 / 16},
+	{"9:21", 9.0 / 21},
+}
+
+// Shape is how a video stream is displayed.
+type Shape struct {
+	Orientation Orientation
+	// AspectRatio is the standard ratio nearest to the display aspect, e.g.
+	// "16:9" for a 1920x1088 encode.
+	AspectRatio string
+}
+
+// DisplayAspect is width/height as shown to the viewer: the coded size
+// stretched by the sample aspect ratio, then rotated. 0 if unknown.
+func (s Stream) DisplayAspect() float64 {
+	if s.Width <= 0 || s.Height <= 0 {
+		return 0
+	}
+	aspect := float64(s.Width) * sampleAspect(s.SampleAspectRatio) / float64(s.Height)
+	if s.Rotation == 90 || s.Rotation == 270 {
+		aspect = 1 / aspect
+	}
+	return aspect
+}
+
+// Classify returns the shape of the stream, ok is false when the stream has
+// no usable dimensions.
+func (s Stream) Classify() (shape Shape, ok bool) {
+	aspect := s.DisplayAspect()
+	if aspect == 0 {
+		return Shape{}, false
+	}
+
+	switch {
+	case math.Abs(aspect-1) <= squareTolerance:
+		shape.Orientation = OrientationSquare
+	case aspect > 1:
+		shape.Orientation = OrientationLandscape
+	default:
+		shape.Orientation = OrientationPortrait
+	}
+
+	// compare in log space so 16:9 and 9:16 are equally tolerant
+	best := math.Inf(1)
+	for _, r := range standardRatios {
+		d := math.Abs(math.Log(aspect / r.Value))
+		if d < best {
+			best = d
+			shape.AspectRatio = r.Name
+		}
+	}
+	return shape, true
+}
+
+// sampleAspect parses ffprobe's sample aspect ratio, "1:1" for square pixels.
+// Missing or unknown ("0:1", "N/A") values mean square pixels.
+func sampleAspect(sar string) float64 {
+	num, den, ok := strings.Cut(sar, ":")
+	if !ok {
+		return 1
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || n <= 0 || d <= 0 {
+		return 1
+	}
+	return n / d
+}
@@ -0,0 +1,42 @@
+package media
+
+import "testing"
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream Stream
+		want   Shape
+		wantOK bool
+	}{
+		{"1080p", Stream{Width: 1920, Height: 1080}, Shape{OrientationLandscape, "16:9"}, true},
+		{"1088 encode", Stream{Width: 1920, Height: 1088}, Shape{OrientationLandscape, "16:9"}, true},
+		{"phone portrait", Stream{Width: 1080, Height: 1920}, Shape{OrientationPortrait, "9:16"}, true},
+		{"phone rotated", Stream{Width: 1920, Height: 1080, Rotation: 90}, Shape{OrientationPortrait, "9:16"}, true},
+		{"upside down", Stream{Width: 1920, Height: 1080, Rotation: 180}, Shape{OrientationLandscape, "16:9"}, true},
+		{"rotated 270", Stream{Width: 1280, Height: 720, Rotation: 270}, Shape{OrientationPortrait, "9:16"}, true},
+		{"square", Stream{Width: 1080, Height: 1080}, Shape{OrientationSquare, "1:1"}, true},
+		{"nearly square", Stream{Width: 1080, Height: 1050}, Shape{OrientationSquare, "1:1"}, true},
+		{"4:5 feed", Stream{Width: 1080, Height: 1350}, Shape{OrientationPortrait, "4:5"}, true},
+		{"SD", Stream{Width: 640, Height: 480}, Shape{OrientationLandscape, "4:3"}, true},
+		{"cinema", Stream{Width: 2560, Height: 1080}, Shape{OrientationLandscape, "21:9"}, true},
+		{"anamorphic DVD", Stream{Width: 720, Height: 480, SampleAspectRatio: "32:27"}, Shape{OrientationLandscape, "16:9"}, true},
+		{"square pixels", Stream{Width: 720, Height: 480, SampleAspectRatio: "1:1"}, Shape{OrientationLandscape, "3:2"}, true},
+		{"unknown sample aspect", Stream{Width: 1920, Height: 1080, SampleAspectRatio: "0:1"}, Shape{OrientationLandscape, "16:9"}, true},
+		{"N/A sample aspect", Stream{Width: 1920, Height: 1080, SampleAspectRatio: "N/A"}, Shape{OrientationLandscape, "16:9"}, true},
+		{"no width", Stream{Height: 1080}, Shape{}, false},
+		{"no height", Stream{Width: 1920}, Shape{}, false},
+		{"negative", Stream{Width: -1920, Height: 1080}, Shape{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.stream.Classify()
+			if ok != tt.wantOK {
+				t.Fatalf("Classify() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if got != tt.want {
+				t.Errorf("Classify() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+var (
+	// ErrUnknownFormat means the file's leading bytes match no accepted format.
+	ErrUnknownFormat = errors.New("unrecognised file format")
+	// ErrPolyglot means the file is valid in its format but also carries
+	// something else: trailing data after the end of the format or markup
+	// another parser would pick up.
+	ErrPolyglot = errors.New("file contains data outside its format")
+)
+
+// sniffWindow is how much of the start of a video is checked for embedded
+// markup.
+const sniffWindow = 64 << 10
+
+// embeddedMarkers are the starts of documents browsers and interpreters
+// recognise anywhere in a file. They are matched without regard to case and
+// are at least five bytes long, so compressed media has them by chance about
+// once in 2^35 positions. SVG is only rendered from a standalone file with its
+// namespace declared.
+var embeddedMarkers = [][]byte{
+	[]byte("<script"),
+	[]byte("<html"),
+	[]byte("<?php"),
+	[]byte("<svg xmlns"),
+	[]byte("<!doctype"),
+	[]byte("%PDF-"),
+}
+
+func checkMarkers(b []byte) error {
+	lower := bytes.ToLower(b)
+	for _, m := range embeddedMarkers {
+		if bytes.Contains(lower, bytes.ToLower(m)) {
+			return fmt.Errorf("%w: embedded %q", ErrPolyglot, m)
+		}
+	}
+	return nil
+}
+
+// Video container types SniffVideo recognises.
+const (
+	TypeMP4       = "video/mp4"
+	TypeQuickTime = "video/quicktime"
+	TypeWebM      = "video/webm"
+	TypeMatroska  = "video/x-matroska"
+	TypeAVI       = "video/x-msvideo"
+)
+
+// SameContainerFamily reports whether two video types share a container
+// structure and differ mostly in labelling: MP4 and QuickTime are both ISO
+// base media, WebM is a Matroska profile. Clients routinely mix them up.
+func SameContainerFamily(a, b string) bool {
+	family := func(t string) string {
+		switch t {
+		case TypeMP4, TypeQuickTime:
+			return "isobmff"
+		case TypeWebM, TypeMatroska:
+			return "matroska"
+		}
+		return t
+	}
+	return family(a) == family(b)
+}
+
+// SniffVideo identifies a video by its structure rather than its name or
+// declared type. The top level structure of the container must cover the
+// whole file, so nothing can hide before or after the movie.
+func SniffVideo(r io.ReaderAt, size int64) (string, error) {
+	head := make([]byte, min(size, sniffWindow))
+	if _, err := r.ReadAt(head, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	if len(head) < 12 {
+		return "", ErrUnknownFormat
+	}
+
+	var mediaType string
+	var err error
+	switch {
+	case quickTimeAtoms[string(head[4:8])]:
+		mediaType = TypeQuickTime
+		if string(head[4:8]) == "ftyp" && string(head[8:12]) != "qt  " {
+			mediaType = TypeMP4
+		}
+		err = walkBoxes(r, size)
+	case bytes.HasPrefix(head, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		mediaType = TypeMatroska
+		if ebmlDocType(head) == "webm" {
+			mediaType = TypeWebM
+		}
+		err = walkEBML(r, size)
+	case string(head[0:4]) == "RIFF" && string(head[8:12]) == "AVI ":
+		mediaType = TypeAVI
+		err = walkRIFF(r, size)
+	default:
+		return "", ErrUnknownFormat
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := checkMarkers(head); err != nil {
+		return "", err
+	}
+	return mediaType, nil
+}
+
+// quickTimeAtoms are the boxes an ISO base media file may start with; old
+// QuickTime files have no ftyp.
+var quickTimeAtoms = map[string]bool{
+	"ftyp": true,
+	"moov": true,
+	"mdat": true,
+	"wide": true,
+	"free": true,
+	"skip": true,
+}
+
+// walkBoxes checks that the top level boxes of an MP4 exactly cover the file.
+func walkBoxes(r io.ReaderAt, size int64) error {
+	var offset int64
+	hdr := make([]byte, 16)
+	for offset < size {
+		if size-offset < 8 {
+			return fmt.Errorf("%w: %d trailing bytes", ErrPolyglot, size-offset)
+		}
+		if _, err := r.ReadAt(hdr[:8], offset); err != nil {
+			return err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(hdr[:4]))
+		if !isBoxType(hdr[4:8]) {
+			return fmt.Errorf("%w: no box at offset %d", ErrPolyglot, offset)
+		}
+		switch boxSize {
+		case 0:
+			// the last box runs to the end of the file
+			return nil
+		case 1:
+			if _, err := r.ReadAt(hdr[8:16], offset+8); err != nil {
+				return err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			if boxSize < 16 {
+				return fmt.Errorf("%w: bad box size at offset %d", ErrUnknownFormat, offset)
+			}
+		default:
+			if boxSize < 8 {
+				return fmt.Errorf("%w: bad box size at offset %d", ErrUnknownFormat, offset)
+			}
+		}
+		if boxSize > size-offset {
+			return fmt.Errorf("%w: box at offset %d runs past the end of the file", ErrUnknownFormat, offset)
+		}
+		offset += boxSize
+	}
+	return nil
+}
+
+// ebmlDocType reads the DocType ("webm", "matroska") from an EBML header.
+func ebmlDocType(head []byte) string {
+	i := bytes.Index(head, []byte{0x42, 0x82})
+	if i < 0 || i+3 > len(head) {
+		return ""
+	}
+	length, n := readVint(head[i+2:])
+	if n == 0 || i+2+n+int(length) > len(head) {
+		return ""
+	}
+	return string(head[i+2+n : i+2+n+int(length)])
+}
+
+// readVint decodes an EBML variable length size, n is 0 if b doesn't start
+// with one. Sizes with every value bit set mean "unknown" and are returned
+// as -1.
+func readVint(b []byte) (value int64, n int) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0
+	}
+	n = 1
+	for mask := byte(0x80); b[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > len(b) {
+		return 0, 0
+	}
+	value = int64(b[0] & (0xff >> n))
+	allOnes := value == int64(0xff>>n)
+	for _, c := range b[1:n] {
+		value = value<<8 | int64(c)
+		allOnes = allOnes && c == 0xff
+	}
+	if allOnes {
+		return -1, n
+	}
+	return value, n
+}
+
+// walkEBML checks that the top level EBML elements, the header and the
+// segment, exactly cover the file. A segment of unknown size, as written by
+// live recorders, runs to the end of the file.
+func walkEBML(r io.ReaderAt, size int64) error {
+	var offset int64
+	buf := make([]byte, 12)
+	for offset < size {
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		_, idLen := readVint(buf[:n])
+		if idLen == 0 || idLen > 4 {
+			return fmt.Errorf("%w: no EBML element at offset %d", ErrPolyglot, offset)
+		}
+		length, sizeLen := readVint(buf[idLen:n])
+		if sizeLen == 0 {
+			return fmt.Errorf("%w: bad EBML size at offset %d", ErrUnknownFormat, offset)
+		}
+		if length < 0 {
+			return nil
+		}
+		end := offset + int64(idLen+sizeLen) + length
+		if end > size || end <= offset {
+			return fmt.Errorf("%w: element at offset %d runs past the end of the file", ErrUnknownFormat, offset)
+		}
+		offset = end
+	}
+	return nil
+}
+
+// walkRIFF checks that RIFF chunks ("AVI " and the "AVIX" extensions of files
+// over 1 GB) exactly cover the file.
+func walkRIFF(r io.ReaderAt, size int64) error {
+	var offset int64
+	hdr := make([]byte, 8)
+	for offset < size {
+		if size-offset < 8 {
+			return fmt.Errorf("%w: %d trailing bytes", ErrPolyglot, size-offset)
+		}
+		if _, err := r.ReadAt(hdr, offset); err != nil {
+			return err
+		}
+		if string(hdr[:4]) != "RIFF" {
+			return fmt.Errorf("%w: no RIFF chunk at offset %d", ErrPolyglot, offset)
+		}
+		length := int64(binary.LittleEndian.Uint32(hdr[4:]))
+		end := offset + 8 + length + length%2
+		if end > size+length%2 {
+			return fmt.Errorf("%w: chunk at offset %d runs past the end of the file", ErrUnknownFormat, offset)
+		}
+		offset = end
+	}
+	return nil
+}
+
+// isBoxType reports whether b looks like a four character box type.
+func isBoxType(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// SniffImage identifies a JPEG or PNG by its structure, rejecting anything
+// appended after the image ends, and decodes its header.
+func SniffImage(data []byte) (string, image.Config, error) {
+	var mediaType string
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		mediaType = "image/png"
+		if err := checkPNGEnd(data); err != nil {
+			return "", image.Config{}, err
+		}
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}):
+		mediaType = "image/jpeg"
+		if !bytes.HasSuffix(bytes.TrimRight(data, "\x00"), []byte{0xff, 0xd9}) {
+			return "", image.Config{}, fmt.Errorf("%w: data after the end of the JPEG", ErrPolyglot)
+		}
+	default:
+		return "", image.Config{}, ErrUnknownFormat
+	}
+	// pixel data is compressed and would match short markers by chance,
+	// markup is hidden in the metadata
+	for _, segment := range imageMetadata(data, mediaType) {
+		if err := checkMarkers(segment); err != nil {
+			return "", image.Config{}, err
+		}
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", image.Config{}, fmt.Errorf("%w: %v", ErrUnknownFormat, err)
+	}
+	if "image/"+format != mediaType {
+		return "", image.Config{}, ErrUnknownFormat
+	}
+	return mediaType, config, nil
+}
+
+// checkPNGEnd walks the PNG chunks and requires IEND to be the last bytes.
+func checkPNGEnd(data []byte) error {
+	offset := 8
+	for offset+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		chunk := string(data[offset+4 : offset+8])
+		end := offset + 12 + length
+		if length < 0 || end > len(data) || end < offset {
+			return fmt.Errorf("%w: truncated PNG chunk", ErrUnknownFormat)
+		}
+		if chunk == "IEND" {
+			if end != len(data) {
+				return fmt.Errorf("%w: data after the end of the PNG", ErrPolyglot)
+			}
+			return nil
+		}
+		offset = end
+	}
+	return fmt.Errorf("%w: PNG without IEND", ErrUnknownFormat)
+}
+
+// imageMetadata returns the payloads of the segments of an image that carry
+// free form data: a JPEG's APPn and comment segments, a PNG's text and EXIF
+// chunks.
+func imageMetadata(data []byte, mediaType string) [][]byte {
+	var segments [][]byte
+	switch mediaType {
+	case "image/jpeg":
+		i := 2
+		for i+4 <= len(data) && data[i] == 0xff {
+			marker := data[i+1]
+			if marker == 0xff {
+				// fill byte
+				i++
+				continue
+			}
+			if marker == 0xda || marker == 0xd9 {
+				break
+			}
+			if (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+				i += 2
+				continue
+			}
+			end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+			if end > len(data) {
+				break
+			}
+			if (marker >= 0xe0 && marker <= 0xef) || marker == 0xfe {
+				segments = append(segments, data[i+4:end])
+			}
+			i = end
+		}
+	case "image/png":
+		offset := 8
+		for offset+12 <= len(data) {
+			length := int(binary.BigEndian.Uint32(data[offset:]))
+			end := offset + 12 + length
+			if end > len(data) || end < offset {
+				break
+			}
+			switch string(data[offset+4 : offset+8]) {
+			case "tEXt", "iTXt", "zTXt", "eXIf":
+				segments = append(segments, data[offset+8:end-4])
+			}
+			offset = end
+		}
+	}
+	return segments
+}
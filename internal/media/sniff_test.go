@@ -0,0 +1,193 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func box(typ string, payload []byte) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+	copy(b[4:], typ)
+	return append(b, payload...)
+}
+
+func mp4(brand string) []byte {
+	ftyp := box("ftyp", []byte(brand+"\x00\x00\x02\x00isomiso2"))
+	return append(ftyp, box("mdat", bytes.Repeat([]byte{0x5a}, 64))...)
+}
+
+func ebmlElement(id []byte, payload []byte) []byte {
+	b := append([]byte{}, id...)
+	b = append(b, 0x80|byte(len(payload)))
+	return append(b, payload...)
+}
+
+func matroska(docType string) []byte {
+	header := ebmlElement([]byte{0x1a, 0x45, 0xdf, 0xa3}, ebmlElement([]byte{0x42, 0x82}, []byte(docType)))
+	return append(header, ebmlElement([]byte{0x18, 0x53, 0x80, 0x67}, make([]byte, 16))...)
+}
+
+func avi() []byte {
+	payload := append([]byte("AVI "), make([]byte, 12)...)
+	b := []byte("RIFF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func TestSniffVideo(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{"mp4", mp4("isom"), TypeMP4, nil},
+		{"quicktime", mp4("qt  "), TypeQuickTime, nil},
+		{"webm", matroska("webm"), TypeWebM, nil},
+		{"matroska", matroska("matroska"), TypeMatroska, nil},
+		{"avi", avi(), TypeAVI, nil},
+		{"mp4 with a box as large as the file", append(box("ftyp", []byte("isom\x00\x00\x02\x00")), 0, 0, 0, 0, 'm', 'd', 'a', 't'), TypeMP4, nil},
+		{"too short", []byte("ftyp"), "", ErrUnknownFormat},
+		{"text", []byte("just some text, not a video"), "", ErrUnknownFormat},
+		{"mp4 with trailing bytes", append(mp4("isom"), "abc"...), "", ErrPolyglot},
+		{"mp4 with appended zip", append(mp4("isom"), "PK\x03\x04\x14\x00\x00\x00\x08\x00"...), "", ErrPolyglot},
+		{"mp4 with a box past the end", mp4("isom")[:40], "", ErrUnknownFormat},
+		{"mp4 with embedded script", append(box("ftyp", []byte("isom\x00\x00\x02\x00")), box("free", []byte("<SCRIPT>alert(1)</script>"))...), "", ErrPolyglot},
+		{"matroska with trailing bytes", append(matroska("webm"), 0x00, 0x01), "", ErrPolyglot},
+		{"avi with trailing bytes", append(avi(), "trailing"...), "", ErrPolyglot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SniffVideo(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SniffVideo() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("SniffVideo() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 6; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 30), uint8(y * 40), 90, 255})
+		}
+	}
+	return img
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngChunk builds a chunk with a valid CRC.
+func pngChunk(typ string, payload []byte) []byte {
+	b := make([]byte, 4, 12+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	b = append(b, typ...)
+	b = append(b, payload...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[4:]))
+}
+
+// withPNGChunk inserts a chunk right after IHDR.
+func withPNGChunk(data, chunk []byte) []byte {
+	ihdrEnd := 8 + 12 + int(binary.BigEndian.Uint32(data[8:]))
+	out := append([]byte{}, data[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+// jpegSegment builds a marker segment with its length.
+func jpegSegment(marker byte, payload []byte) []byte {
+	b := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(payload)+2))
+	return append(b, payload...)
+}
+
+// withJPEGSegment inserts a segment right after SOI.
+func withJPEGSegment(data, segment []byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestSniffImage(t *testing.T) {
+	pngData := testPNG(t)
+	jpegData := testJPEG(t)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr error
+	}{
+		{"png", pngData, "image/png", nil},
+		{"jpeg", jpegData, "image/jpeg", nil},
+		{"jpeg with padding after EOI", append(append([]byte{}, jpegData...), 0, 0), "image/jpeg", nil},
+		{"png with harmless text", withPNGChunk(pngData, pngChunk("tEXt", []byte("Comment\x00an svg of a cat"))), "image/png", nil},
+		{"jpeg with harmless comment", withJPEGSegment(jpegData, jpegSegment(0xfe, []byte("<svg> is not a complete marker"))), "image/jpeg", nil},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), "", ErrUnknownFormat},
+		{"empty", nil, "", ErrUnknownFormat},
+		{"png with trailing data", append(append([]byte{}, pngData...), "<?php echo 1; ?>"...), "", ErrPolyglot},
+		{"jpeg with trailing data", append(append([]byte{}, jpegData...), "PK\x03\x04"...), "", ErrPolyglot},
+		{"png without IEND", pngData[:len(pngData)-12], "", ErrUnknownFormat},
+		{"png with html in a text chunk", withPNGChunk(pngData, pngChunk("tEXt", []byte("Comment\x00<html><body>"))), "", ErrPolyglot},
+		{"jpeg with svg in a comment", withJPEGSegment(jpegData, jpegSegment(0xfe, []byte(`<SVG XMLNS="http://www.w3.org/2000/svg">`))), "", ErrPolyglot},
+		{"jpeg with script in XMP", withJPEGSegment(jpegData, jpegSegment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<script>"))), "", ErrPolyglot},
+		{"png labelled chunks over a jpeg", append([]byte("\x89PNG\r\n\x1a\n"), jpegData...), "", ErrUnknownFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, config, err := SniffImage(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("SniffImage() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("SniffImage() = %q, want %q", got, tt.want)
+			}
+			if err == nil && (config.Width != 8 || config.Height != 6) {
+				t.Errorf("SniffImage() size = %dx%d, want 8x6", config.Width, config.Height)
+			}
+		})
+	}
+}
+
+func TestSniffImageIgnoresPixelData(t *testing.T) {
+	// markers in the entropy coded data are chance, not markup
+	jpegData := testJPEG(t)
+	sos := bytes.Index(jpegData, []byte{0xff, 0xda})
+	if sos < 0 {
+		t.Fatal("no start of scan")
+	}
+	data := append([]byte{}, jpegData[:len(jpegData)-2]...)
+	data = append(data, "<html"...)
+	data = append(data, 0xff, 0xd9)
+	if _, _, err := SniffImage(data); errors.Is(err, ErrPolyglot) {
+		t.Errorf("SniffImage() error = %v, want no polyglot for markers after the start of scan", err)
+	}
+}
@@ -0,0 +1,185 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// StripMetadata removes camera, location and editing metadata (EXIF, XMP,
+// IPTC, text chunks) from a JPEG or PNG without re-encoding the pixels.
+// Colour profiles are kept, and so is a JPEG's EXIF orientation, in an EXIF
+// block of its own, since the pixels are stored the way the camera held them.
+func StripMetadata(data []byte, mediaType string) ([]byte, error) {
+	switch mediaType {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, mediaType)
+	}
+}
+
+// jpegDropped are the markers removed from JPEGs: APP1 (EXIF, XMP), APP13
+// (IPTC) and comments.
+var jpegDropped = map[byte]bool{0xe1: true, 0xed: true, 0xfe: true}
+
+func stripJPEG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return nil, ErrUnknownFormat
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xff {
+			return nil, fmt.Errorf("%w: no JPEG marker at offset %d", ErrUnknownFormat, i)
+		}
+		// markers may be preceded by any number of fill bytes
+		for i+1 < len(data) && data[i+1] == 0xff {
+			i++
+		}
+		if i+1 >= len(data) {
+			return nil, fmt.Errorf("%w: truncated JPEG", ErrUnknownFormat)
+		}
+		marker := data[i+1]
+		if marker == 0xd9 || (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+			// standalone markers carry no length
+			out.Write(data[i : i+2])
+			i += 2
+			continue
+		}
+		if i+4 > len(data) {
+			return nil, fmt.Errorf("%w: truncated JPEG", ErrUnknownFormat)
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, fmt.Errorf("%w: truncated JPEG segment", ErrUnknownFormat)
+		}
+		if marker == 0xda {
+			// start of scan, the entropy coded data runs to EOI
+			out.Write(data[i:])
+			return out.Bytes(), nil
+		}
+		if !jpegDropped[marker] {
+			out.Write(data[i:end])
+		} else if o := exifOrientation(data[i+4 : end]); marker == 0xe1 && o > 1 {
+			out.Write(orientationSegment(o))
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
+
+// JPEGOrientation returns the EXIF orientation of a JPEG, 1 to 8, where 1 is
+// upright and also the answer for images without one.
+func JPEGOrientation(data []byte) int {
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return 1
+	}
+	i := 2
+	for i+4 <= len(data) && data[i] == 0xff {
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			break
+		}
+		if marker == 0xe1 {
+			if o := exifOrientation(data[i+4 : end]); o > 0 {
+				return o
+			}
+		}
+		i = end
+	}
+	return 1
+}
+
+// exifOrientation reads the Orientation tag from the first IFD of an APP1
+// payload, 0 if it is not EXIF or has none.
+func exifOrientation(payload []byte) int {
+	tiff, ok := bytes.CutPrefix(payload, []byte("Exif\x00\x00"))
+	if !ok || len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for e := ifd + 2; e+12 <= len(tiff) && n > 0; e, n = e+12, n-1 {
+		// SHORT, one value, stored in the entry itself
+		if order.Uint16(tiff[e:]) == 0x0112 && order.Uint16(tiff[e+2:]) == 3 {
+			o := int(order.Uint16(tiff[e+8:]))
+			if o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// orientationSegment is an APP1 segment with an EXIF block holding nothing
+// but the orientation.
+func orientationSegment(orientation int) []byte {
+	tiff := []byte{
+		'M', 'M', 0x00, 0x2a, // big endian TIFF header
+		0x00, 0x00, 0x00, 0x08, // first IFD right after it
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, // Orientation, SHORT, 1 value
+		0x00, byte(orientation), 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, // no next IFD
+	}
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// pngDropped are the ancillary chunks removed from PNGs.
+var pngDropped = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"iTXt": true,
+	"zTXt": true,
+	"tIME": true,
+}
+
+func stripPNG(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, ErrUnknownFormat
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:8])
+	offset := 8
+	for offset+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		end := offset + 12 + length
+		if end > len(data) || end < offset {
+			return nil, fmt.Errorf("%w: truncated PNG chunk", ErrUnknownFormat)
+		}
+		chunk := string(data[offset+4 : offset+8])
+		if !pngDropped[chunk] {
+			out.Write(data[offset:end])
+		}
+		if chunk == "IEND" {
+			return out.Bytes(), nil
+		}
+		offset = end
+	}
+	return nil, fmt.Errorf("%w: PNG without IEND", ErrUnknownFormat)
+}
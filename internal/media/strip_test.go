@@ -0,0 +1,151 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"testing"
+)
+
+// exifSegment is an APP1 segment with a GPS-ish string and, if orientation
+// isn't 0, an Orientation tag.
+func exifSegment(orientation int) []byte {
+	tiff := []byte{'I', 'I', 0x2a, 0x00, 0x08, 0x00, 0x00, 0x00}
+	if orientation == 0 {
+		tiff = append(tiff, 0x00, 0x00)
+	} else {
+		tiff = append(tiff, 0x01, 0x00, 0x12, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, byte(orientation), 0x00, 0x00, 0x00)
+	}
+	tiff = append(tiff, 0x00, 0x00, 0x00, 0x00)
+	tiff = append(tiff, "GPS 52.5200N 13.4050E"...)
+	return jpegSegment(0xe1, append([]byte("Exif\x00\x00"), tiff...))
+}
+
+func TestStripMetadata(t *testing.T) {
+	jpegData := testJPEG(t)
+	pngData := testPNG(t)
+
+	tests := []struct {
+		name            string
+		data            []byte
+		mediaType       string
+		gone            []string
+		kept            []string
+		wantOrientation int
+		wantErr         error
+	}{
+		{
+			name:            "jpeg exif",
+			data:            withJPEGSegment(jpegData, exifSegment(0)),
+			mediaType:       "image/jpeg",
+			gone:            []string{"GPS", "Exif"},
+			wantOrientation: 1,
+		},
+		{
+			name:            "jpeg exif keeps orientation",
+			data:            withJPEGSegment(jpegData, exifSegment(6)),
+			mediaType:       "image/jpeg",
+			gone:            []string{"GPS"},
+			wantOrientation: 6,
+		},
+		{
+			name:            "jpeg comment and iptc",
+			data:            withJPEGSegment(withJPEGSegment(jpegData, jpegSegment(0xfe, []byte("shot at home"))), jpegSegment(0xed, []byte("Photoshop 3.0\x00by someone"))),
+			mediaType:       "image/jpeg",
+			gone:            []string{"shot at home", "by someone"},
+			wantOrientation: 1,
+		},
+		{
+			name:            "jpeg colour profile",
+			data:            withJPEGSegment(jpegData, jpegSegment(0xe2, []byte("ICC_PROFILE\x00\x01\x01profile"))),
+			mediaType:       "image/jpeg",
+			kept:            []string{"ICC_PROFILE"},
+			wantOrientation: 1,
+		},
+		{
+			name:      "png text and time",
+			data:      withPNGChunk(withPNGChunk(pngData, pngChunk("tEXt", []byte("Author\x00someone"))), pngChunk("tIME", []byte{0x07, 0xe8, 1, 2, 3, 4, 5})),
+			mediaType: "image/png",
+			gone:      []string{"someone", "tIME"},
+		},
+		{
+			name:      "png gamma",
+			data:      withPNGChunk(pngData, pngChunk("gAMA", []byte{0, 0, 0xb1, 0x8f})),
+			mediaType: "image/png",
+			kept:      []string{"gAMA"},
+		},
+		{
+			name:      "truncated png",
+			data:      pngData[:len(pngData)-12],
+			mediaType: "image/png",
+			wantErr:   ErrUnknownFormat,
+		},
+		{
+			name:      "truncated jpeg segment",
+			data:      append([]byte{0xff, 0xd8}, 0xff, 0xe1, 0x01, 0x00, 'E'),
+			mediaType: "image/jpeg",
+			wantErr:   ErrUnknownFormat,
+		},
+		{
+			name:      "png as jpeg",
+			data:      pngData,
+			mediaType: "image/jpeg",
+			wantErr:   ErrUnknownFormat,
+		},
+		{
+			name:      "gif",
+			data:      []byte("GIF89a"),
+			mediaType: "image/gif",
+			wantErr:   ErrUnknownFormat,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := StripMetadata(tt.data, tt.mediaType)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("StripMetadata() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			for _, s := range tt.gone {
+				if bytes.Contains(got, []byte(s)) {
+					t.Errorf("StripMetadata() kept %q", s)
+				}
+			}
+			for _, s := range tt.kept {
+				if !bytes.Contains(got, []byte(s)) {
+					t.Errorf("StripMetadata() dropped %q", s)
+				}
+			}
+			if tt.mediaType == "image/jpeg" {
+				if o := JPEGOrientation(got); o != tt.wantOrientation {
+					t.Errorf("JPEGOrientation() = %d, want %d", o, tt.wantOrientation)
+				}
+			}
+			// the pixels are untouched, so the result still decodes
+			config, _, err := image.DecodeConfig(bytes.NewReader(got))
+			if err != nil {
+				t.Fatalf("stripped image doesn't decode: %v", err)
+			}
+			if config.Width != 8 || config.Height != 6 {
+				t.Errorf("stripped image is %dx%d, want 8x6", config.Width, config.Height)
+			}
+		})
+	}
+}
+
+func TestStripMetadataKeepsScanData(t *testing.T) {
+	jpegData := testJPEG(t)
+	got, err := StripMetadata(withJPEGSegment(jpegData, exifSegment(0)), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, jpegData) {
+		t.Errorf("StripMetadata() changed more than the EXIF segment: %d bytes, want %d", len(got), len(jpegData))
+	}
+	if binary.BigEndian.Uint16(got) != 0xffd8 {
+		t.Errorf("StripMetadata() lost the start of image")
+	}
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gpr3211/boot-s3-course/internal/cdn"
+)
+
+// CloudFrontStore serves objects of an origin store through a CloudFront
+// distribution. Reads and writes still go to the origin, only URL changes.
+// domain is the bare distribution host, e.g. d111111abcdef8.cloudfront.net.
+type CloudFrontStore struct {
+	BlobStore
+	domain string
+	signer *cdn.Signer // nil serves plain unsigned URLs
+	expiry time.Duration
+}
+
+func NewCloudFrontStore(origin BlobStore, domain string, signer *cdn.Signer, expiry time.Duration) *CloudFrontStore {
+	return &CloudFrontStore{
+		BlobStore: origin,
+		domain:    domain,
+		signer:    signer,
+		expiry:    expiry,
+	}
+}
+
+func (c *CloudFrontStore) URL(ctx context.Context, key string) (string, error) {
+	u := fmt.Sprintf("https://%s/%s", c.domain, key)
+	if c.signer == nil {
+		return u, nil
+	}
+	return c.signer.SignURL(u, time.Now().Add(c.expiry))
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	minPartSize  = 5 << 20 // S3 rejects smaller parts (except the last)
+	maxParts     = 10000
+	partAttempts = 3
+)
+
+// partRetryBackoff is the wait before retrying a part, doubled every attempt.
+var partRetryBackoff = time.Second
+
+// putMultipart streams body to S3 as a multipart upload. first is the part
+// already read by Put. At most concurrency+1 part buffers are alive at once,
+// each part is retried on its own and the upload is aborted on failure so no
+// orphaned parts keep costing money.
+func (s *S3Store) putMultipart(ctx context.Context, key string, first []byte, body io.Reader, contentType string) error {
+	created, err := s.client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+		// every part is verified by S3, the object gets a checksum of the
+		// part checksums
+		ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+	})
+	if err != nil {
+		return err
+	}
+	uploadID := created.UploadId
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type part struct {
+		number int32
+		data   []byte
+	}
+	var (
+		mu        sync.Mutex
+		completed []types.CompletedPart
+		uploadErr error
+		wg        sync.WaitGroup
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if uploadErr == nil {
+			uploadErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	parts := make(chan part)
+	pool := make(chan []byte, s.concurrency+1)
+	allocated := 1 // first
+
+	for i := 0; i < s.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range parts {
+				done, err := s.uploadPart(ctx, key, uploadID, p.number, p.data)
+				pool <- p.data[:cap(p.data)]
+				if err != nil {
+					fail(fmt.Errorf("part %d: %w", p.number, err))
+					continue
+				}
+				mu.Lock()
+				completed = append(completed, done)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	data := first
+	for number := int32(1); ; number++ {
+		if number > maxParts {
+			fail(fmt.Errorf("object needs more than %d parts, increase the part size", maxParts))
+			break
+		}
+		select {
+		case parts <- part{number: number, data: data}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil || int64(len(data)) < s.partSize {
+			// failed, or that was the short final part
+			break
+		}
+
+		var buf []byte
+		select {
+		case buf = <-pool:
+		default:
+			if allocated <= s.concurrency {
+				buf = make([]byte, s.partSize)
+				allocated++
+			} else {
+				select {
+				case buf = <-pool:
+				case <-ctx.Done():
+				}
+			}
+		}
+		if buf == nil {
+			break
+		}
+
+		n, err := io.ReadFull(body, buf)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			fail(err)
+			break
+		}
+		data = buf[:n]
+	}
+	close(parts)
+	wg.Wait()
+
+	if uploadErr == nil && ctx.Err() != nil {
+		uploadErr = ctx.Err()
+	}
+	if uploadErr != nil {
+		return s.abortMultipart(key, uploadID, uploadErr)
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		// the uploaded parts are kept until aborted
+		return s.abortMultipart(key, uploadID, err)
+	}
+	return nil
+}
+
+// abortMultipart drops the parts of a failed upload and returns uploadErr.
+func (s *S3Store) abortMultipart(key string, uploadID *string, uploadErr error) error {
+	// the request context may be gone, abort regardless
+	_, abortErr := s.client.AbortMultipartUpload(context.Background(), &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if abortErr != nil {
+		return fmt.Errorf("%w (abort failed: %v)", uploadErr, abortErr)
+	}
+	return uploadErr
+}
+
+func (s *S3Store) uploadPart(ctx context.Context, key string, uploadID *string, number int32, data []byte) (types.CompletedPart, error) {
+	var err error
+	for attempt := 0; attempt < partAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(partRetryBackoff << (attempt - 1)):
+			case <-ctx.Done():
+				return types.CompletedPart{}, ctx.Err()
+			}
+		}
+		var out *s3.UploadPartOutput
+		out, err = s.client.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:            aws.String(s.bucket),
+			Key:               aws.String(key),
+			UploadId:          uploadID,
+			PartNumber:        aws.Int32(number),
+			Body:              bytes.NewReader(data),
+			ContentLength:     aws.Int64(int64(len(data))),
+			ChecksumAlgorithm: types.ChecksumAlgorithmSha256,
+		})
+		if err == nil {
+			return types.CompletedPart{
+				ETag:           out.ETag,
+				PartNumber:     aws.Int32(number),
+				ChecksumSHA256: out.ChecksumSHA256,
+			}, nil
+		}
+		if ctx.Err() != nil {
+			return types.CompletedPart{}, ctx.Err()
+		}
+	}
+	return types.CompletedPart{}, err
+}
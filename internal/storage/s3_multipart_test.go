@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fakeS3 keeps objects and multipart uploads in memory.
+type fakeS3 struct {
+	s3API // methods the tests don't use panic
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int32][]byte
+	nextID   int
+	puts     int
+	aborted  int
+	partSize map[int32]int
+
+	// failures
+	failCreate   error
+	failComplete error
+	failPart     map[int32]int // part number to times it fails
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:  map[string][]byte{},
+		uploads:  map[string]map[int32][]byte{},
+		partSize: map[int32]int{},
+		failPart: map[int32]int{},
+	}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != aws.ToInt64(in.ContentLength) {
+		return nil, fmt.Errorf("content length %d, sent %d bytes", aws.ToInt64(in.ContentLength), len(data))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.puts++
+	f.objects[aws.ToString(in.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if f.failCreate != nil {
+		return nil, f.failCreate
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = map[int32][]byte{}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	// the store reuses part buffers, so copy before returning
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	number := aws.ToInt32(in.PartNumber)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failPart[number] > 0 {
+		f.failPart[number]--
+		return nil, fmt.Errorf("part %d: connection reset", number)
+	}
+	parts, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, errors.New("NoSuchUpload")
+	}
+	parts[number] = data
+	f.partSize[number] = len(data)
+	return &s3.UploadPartOutput{
+		ETag:           aws.String(fmt.Sprintf(`"etag-%d"`, number)),
+		ChecksumSHA256: aws.String("checksum"),
+	}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	if f.failComplete != nil {
+		return nil, f.failComplete
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, errors.New("NoSuchUpload")
+	}
+	var object []byte
+	for i, p := range in.MultipartUpload.Parts {
+		number := aws.ToInt32(p.PartNumber)
+		if number != int32(i+1) {
+			return nil, fmt.Errorf("part %d listed as number %d", i+1, number)
+		}
+		if aws.ToString(p.ETag) != fmt.Sprintf(`"etag-%d"`, number) {
+			return nil, fmt.Errorf("part %d has ETag %s", number, aws.ToString(p.ETag))
+		}
+		data, ok := parts[number]
+		if !ok {
+			return nil, fmt.Errorf("part %d wasn't uploaded", number)
+		}
+		object = append(object, data...)
+	}
+	if len(in.MultipartUpload.Parts) != len(parts) {
+		return nil, fmt.Errorf("%d parts listed, %d uploaded", len(in.MultipartUpload.Parts), len(parts))
+	}
+	delete(f.uploads, aws.ToString(in.UploadId))
+	f.objects[aws.ToString(in.Key)] = object
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.uploads[aws.ToString(in.UploadId)]; !ok {
+		return nil, errors.New("NoSuchUpload")
+	}
+	delete(f.uploads, aws.ToString(in.UploadId))
+	f.aborted++
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+const testPartSize = 1024
+
+func newTestS3Store(client *fakeS3) *S3Store {
+	return &S3Store{
+		client:      client,
+		bucket:      "bucket",
+		region:      "region",
+		partSize:    testPartSize,
+		concurrency: 3,
+	}
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func TestMain(m *testing.M) {
+	partRetryBackoff = time.Millisecond
+	m.Run()
+}
+
+func TestS3StorePut(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		wantPuts  int
+		wantParts int
+	}{
+		{"empty", 0, 1, 0},
+		{"small", 100, 1, 0},
+		{"one byte short of a part", testPartSize - 1, 1, 0},
+		{"exactly one part", testPartSize, 0, 1},
+		{"one byte over a part", testPartSize + 1, 0, 2},
+		{"many parts", 10*testPartSize + 17, 0, 11},
+		{"whole parts", 6 * testPartSize, 0, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeS3()
+			store := newTestS3Store(client)
+			data := randomBytes(tt.size)
+
+			// one byte per read so parts are assembled from many reads
+			err := store.Put(context.Background(), "key", io.LimitReader(&oneByteReader{bytes.NewReader(data)}, int64(tt.size)), "video/mp4")
+			if err != nil {
+				t.Fatalf("Put() error = %v", err)
+			}
+			if !bytes.Equal(client.objects["key"], data) {
+				t.Errorf("stored %d bytes, want the %d put", len(client.objects["key"]), len(data))
+			}
+			if client.puts != tt.wantPuts {
+				t.Errorf("%d PutObject calls, want %d", client.puts, tt.wantPuts)
+			}
+			if len(client.partSize) != tt.wantParts {
+				t.Errorf("%d parts uploaded, want %d", len(client.partSize), tt.wantParts)
+			}
+			for number, size := range client.partSize {
+				if number < int32(tt.wantParts) && size != testPartSize {
+					t.Errorf("part %d has %d bytes, only the last may be short of %d", number, size, testPartSize)
+				}
+			}
+			if len(client.uploads) != 0 || client.aborted != 0 {
+				t.Errorf("%d uploads left open, %d aborted", len(client.uploads), client.aborted)
+			}
+		})
+	}
+}
+
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p[:1])
+}
+
+func TestS3StorePutMultipartFailures(t *testing.T) {
+	errRead := errors.New("client went away")
+	size := 5*testPartSize + 10
+
+	tests := []struct {
+		name        string
+		setup       func(f *fakeS3)
+		body        func(data []byte) io.Reader
+		wantErr     error
+		wantAborted int
+		wantStored  bool
+	}{
+		{
+			name:       "part retried",
+			setup:      func(f *fakeS3) { f.failPart[2] = partAttempts - 1 },
+			wantStored: true,
+		},
+		{
+			name:        "part out of attempts",
+			setup:       func(f *fakeS3) { f.failPart[3] = partAttempts },
+			wantAborted: 1,
+		},
+		{
+			name: "body fails",
+			body: func(data []byte) io.Reader {
+				return io.MultiReader(bytes.NewReader(data[:3*testPartSize+5]), &errReader{errRead})
+			},
+			wantErr:     errRead,
+			wantAborted: 1,
+		},
+		{
+			name:        "complete fails",
+			setup:       func(f *fakeS3) { f.failComplete = errors.New("InternalError") },
+			wantAborted: 1,
+		},
+		{
+			name:  "create fails",
+			setup: func(f *fakeS3) { f.failCreate = errors.New("AccessDenied") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeS3()
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+			store := newTestS3Store(client)
+			data := randomBytes(size)
+			var body io.Reader = bytes.NewReader(data)
+			if tt.body != nil {
+				body = tt.body(data)
+			}
+
+			err := store.Put(context.Background(), "key", body, "video/mp4")
+			if tt.wantStored {
+				if err != nil {
+					t.Fatalf("Put() error = %v", err)
+				}
+				if !bytes.Equal(client.objects["key"], data) {
+					t.Errorf("stored object differs from what was put")
+				}
+			} else {
+				if err == nil {
+					t.Fatal("Put() succeeded")
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("Put() error = %v, want %v", err, tt.wantErr)
+				}
+				if _, ok := client.objects["key"]; ok {
+					t.Error("failed Put() stored an object")
+				}
+			}
+			if client.aborted != tt.wantAborted {
+				t.Errorf("%d uploads aborted, want %d", client.aborted, tt.wantAborted)
+			}
+			if len(client.uploads) != 0 {
+				t.Errorf("%d uploads left open", len(client.uploads))
+			}
+		})
+	}
+}
+
+func TestS3StorePutCancelled(t *testing.T) {
+	client := newFakeS3()
+	store := newTestS3Store(client)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// cancelled once the first part is read, while the rest is streaming
+	body := io.MultiReader(bytes.NewReader(randomBytes(testPartSize)), &cancelReader{cancel: cancel, r: bytes.NewReader(randomBytes(4 * testPartSize))})
+	err := store.Put(ctx, "key", body, "video/mp4")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Put() error = %v, want %v", err, context.Canceled)
+	}
+	if client.aborted != 1 || len(client.uploads) != 0 {
+		t.Errorf("%d uploads aborted and %d left open, want the upload aborted", client.aborted, len(client.uploads))
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+type cancelReader struct {
+	cancel context.CancelFunc
+	r      io.Reader
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	r.cancel()
+	return r.r.Read(p)
+}
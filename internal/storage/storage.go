@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when the requested key does not exist in the store.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo describes a single stored object.
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"content_type"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// BlobStore is the single abstraction every asset (videos, thumbnails, ...)
+// is written through, so handlers don't care whether bytes end up on the
+// local disk or in a bucket.
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// URL returns an address a client can use to fetch the object.
+	URL(ctx context.Context, key string) (string, error)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/auth"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+)
+
+const (
+	maxJobAttempts  = 3
+	jobRetryBackoff = 30 * time.Second
+	jobPollInterval = 5 * time.Second
+)
+
+// enqueueVideoJob records a durable processing job for the file at srcPath,
+// which must live somewhere that survives restarts, and sum, its hex SHA-256.
+// The job owns the file from here on and removes it when it is done with it.
+// Its size stays reserved against the owner's quota until then.
+func (cfg *apiConfig) enqueueVideoJob(videoID uuid.UUID, srcPath, mediaType, sum string) (database.Job, error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return database.Job{}, err
+	}
+	job, err := cfg.db.CreateJob(database.CreateJobParams{
+		VideoID:      videoID,
+		SourcePath:   srcPath,
+		MediaType:    mediaType,
+		SourceSHA256: sum,
+		SourceSize:   info.Size(),
+	})
+	if err != nil {
+		return database.Job{}, err
+	}
+	select {
+	case cfg.jobWake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// runJobWorkers starts n workers pulling jobs from the database until ctx is done.
+func (cfg *apiConfig) runJobWorkers(ctx context.Context, n int) {
+	requeued, err := cfg.db.RequeueRunningJobs()
+	if err != nil {
+		log.Printf("Couldn't requeue interrupted jobs: %v", err)
+	} else if requeued > 0 {
+		log.Printf("Requeued %d interrupted processing jobs", requeued)
+	}
+
+	for i := 0; i < n; i++ {
+		go cfg.jobWorker(ctx)
+	}
+}
+
+func (cfg *apiConfig) jobWorker(ctx context.Context) {
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+	for {
+		job, ok, err := cfg.db.ClaimJob()
+		if err != nil {
+			log.Printf("Couldn't claim job: %v", err)
+		}
+		if ok {
+			cfg.runJob(ctx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-cfg.jobWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) runJob(ctx context.Context, job database.Job) {
+	progress := func(status string) {
+		if err := cfg.db.UpdateJobStatus(job.ID, status, nil); err != nil {
+			log.Printf("Couldn't update job %s: %v", job.ID, err)
+		}
+	}
+
+	// a bug in the pipeline fails this job, not the worker
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("job panicked: %v", p)
+			}
+		}()
+		return cfg.processJob(ctx, job, progress)
+	}()
+	if err == nil {
+		progress(database.JobStatusReady)
+		os.Remove(job.SourcePath)
+		return
+	}
+
+	log.Printf("Job %s for video %s failed (attempt %d): %v", job.ID, job.VideoID, job.Attempts, err)
+	// a rejected upload, e.g. over quota, fails the same way again
+	var rej *uploadRejection
+	if job.Attempts < maxJobAttempts && !errors.As(err, &rej) {
+		backoff := jobRetryBackoff << (job.Attempts - 1)
+		if err := cfg.db.RetryJob(job.ID, err, time.Now().Add(backoff)); err != nil {
+			log.Printf("Couldn't requeue job %s: %v", job.ID, err)
+		}
+		return
+	}
+	os.Remove(job.SourcePath)
+	if err := cfg.db.UpdateJobStatus(job.ID, database.JobStatusFailed, err); err != nil {
+		log.Printf("Couldn't update job %s: %v", job.ID, err)
+	}
+}
+
+func (cfg *apiConfig) processJob(ctx context.Context, job database.Job, progress func(string)) error {
+	video, err := cfg.db.GetVideo(job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("video %s no longer exists", job.VideoID)
+	}
+	return cfg.processVideo(ctx, video, job.SourcePath, job.MediaType, job.SourceSHA256, progress)
+}
+
+func (cfg *apiConfig) handlerVideoJobGet(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't view this video's jobs", nil)
+		return
+	}
+
+	job, err := cfg.db.GetLatestJob(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get job", err)
+		return
+	}
+	if job.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "No processing job for this video", nil)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, job)
+}
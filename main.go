@@ -2,35 +2,53 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gpr3211/boot-s3-course/internal/cdn"
 	"github.com/gpr3211/boot-s3-course/internal/database"
+	"github.com/gpr3211/boot-s3-course/internal/media"
+	"github.com/gpr3211/boot-s3-course/internal/storage"
 	"github.com/joho/godotenv"
 
 	_ "github.com/lib/pq"
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string // assetsRoot path where asset files like thumbnails are stored
-	s3Bucket         string
-	s3Region         string
-	s3Client         *s3.Client
-	s3CfDistribution string
-	port             string
-}
-
-// thumbnail
-type thumbnail struct {
-	data      []byte
-	mediaType string
+	db                database.Client
+	jwtSecret         string
+	platform          string
+	filepathRoot      string
+	assetsRoot        string // assetsRoot path where asset files like thumbnails are stored
+	s3Bucket          string
+	s3Region          string
+	s3CfDistribution  string
+	store             storage.BlobStore // store holds every uploaded asset, local disk or S3
+	cdnSigner         *cdn.Signer       // nil unless CloudFront signed URLs are configured
+	cdnCookieDomain   string
+	cdnURLExpiry      time.Duration
+	uploadsDir        string        // uploadsDir holds partial resumable uploads
+	uploadLocks       *uploadLocks  // one lock per in-flight resumable upload
+	jobWake           chan struct{} // nudges idle processing workers when a job is queued
+	prober            media.Prober
+	maxVideoDuration  time.Duration // 0 disables the limit
+	maxVideoDimension int           // longest side in pixels, 0 disables the limit
+	maxImageDimension int
+	allowedVideoTypes map[string]bool // upload containers accepted for processing
+	keepSourceMaster  bool            // store uploads as received next to the MP4
+	renditions        []rendition     // adaptive bitrate ladder shared by every streaming format
+	streamFormats     []streamFormat  // HLS and/or DASH packaging, empty serves the MP4 only
+	defaultQuota      quota           // per user, admins can override it
+	adminAPIKey       string
+	gcGracePeriod     time.Duration // unreferenced objects younger than this are kept
+	port              string
 }
 
 func main() {
@@ -46,6 +64,16 @@ func main() {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
+	// a build without the sqlite_fts5 tag would quietly answer every search
+	// with 501
+	videoSearch, err := boolEnv("VIDEO_SEARCH", true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if videoSearch && !db.SearchAvailable() {
+		log.Fatalf("%v, or set VIDEO_SEARCH=false to run without search", database.ErrSearchUnavailable)
+	}
+
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
 		log.Fatal("JWT_SECRET environment variable is not set")
@@ -66,42 +94,207 @@ func main() {
 		log.Fatal("ASSETS_ROOT environment variable is not set")
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	port := os.Getenv("PORT")
+	if port == "" {
+		log.Fatal("PORT environment variable is not set")
+	}
+
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend == "" {
+		storageBackend = "s3"
 	}
 
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	var s3Bucket, s3Region, s3CfDistribution string
+	var store storage.BlobStore
+	var cdnSigner *cdn.Signer
+	var cdnURLExpiry time.Duration
+	switch storageBackend {
+	case "s3":
+		s3Bucket = os.Getenv("S3_BUCKET")
+		if s3Bucket == "" {
+			log.Fatal("S3_BUCKET environment variable is not set")
+		}
+
+		s3Region = os.Getenv("S3_REGION")
+		if s3Region == "" {
+			log.Fatal("S3_REGION environment variable is not set")
+		}
+
+		presignExpiry, err := durationEnv("S3_PRESIGN_EXPIRY", 15*time.Minute)
+		if err != nil {
+			log.Fatal(err)
+		}
+		partSize, err := intEnv("S3_PART_SIZE_MB", 16)
+		if err != nil {
+			log.Fatal(err)
+		}
+		concurrency, err := intEnv("S3_UPLOAD_CONCURRENCY", 4)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s3Conf, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+		if err != nil {
+			log.Fatalf("Failed to load AWS config: %v", err)
+		}
+		store = storage.NewS3Store(s3.NewFromConfig(s3Conf), s3Bucket, s3Region, storage.S3Options{
+			PresignExpiry: presignExpiry,
+			PartSize:      int64(partSize) << 20,
+			Concurrency:   concurrency,
+		})
+
+		// with a distribution configured viewers go through the CDN instead of the bucket
+		s3CfDistribution = os.Getenv("S3_CF_DISTRO")
+		s3CfDistribution = strings.TrimPrefix(strings.TrimPrefix(s3CfDistribution, "https://"), "http://")
+		s3CfDistribution = strings.TrimSuffix(s3CfDistribution, "/")
+		if s3CfDistribution != "" {
+			cdnURLExpiry, err = durationEnv("CF_URL_EXPIRY", time.Hour)
+			if err != nil {
+				log.Fatal(err)
+			}
+			keyPairID := os.Getenv("CF_KEY_PAIR_ID")
+			keyPath := os.Getenv("CF_PRIVATE_KEY_PATH")
+			if keyPairID != "" || keyPath != "" {
+				if keyPairID == "" || keyPath == "" {
+					log.Fatal("CF_KEY_PAIR_ID and CF_PRIVATE_KEY_PATH must be set together")
+				}
+				key, err := cdn.LoadPrivateKey(keyPath)
+				if err != nil {
+					log.Fatalf("Couldn't load CloudFront private key: %v", err)
+				}
+				cdnSigner = cdn.NewSigner(keyPairID, key)
+			}
+			store = storage.NewCloudFrontStore(store, s3CfDistribution, cdnSigner, cdnURLExpiry)
+		}
+	case "local":
+		store, err = storage.NewLocalStore(assetsRoot, fmt.Sprintf("http://localhost:%s/assets", port))
+		if err != nil {
+			log.Fatalf("Couldn't create local storage: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q, expected s3 or local", storageBackend)
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	uploadsDir := os.Getenv("UPLOADS_DIR")
+	if uploadsDir == "" {
+		uploadsDir = "./uploads"
 	}
-	s3Conf, err := config.LoadDefaultConfig(context.Background(), config.WithRegion("us-east-1"))
+	err = os.MkdirAll(uploadsDir, 0755)
 	if err != nil {
-		log.Fatal("Failed to load us config")
+		log.Fatalf("Couldn't create uploads directory: %v", err)
 	}
-	bucketclient := s3.NewFromConfig(s3Conf)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	videoWorkers, err := intEnv("VIDEO_WORKERS", 2)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	probeTimeout, err := durationEnv("FFPROBE_TIMEOUT", 30*time.Second)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	maxVideoDuration, err := durationEnv("MAX_VIDEO_DURATION", 4*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxVideoDimension, err := intEnv("MAX_VIDEO_DIMENSION", 7680)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxImageDimension, err := intEnv("MAX_IMAGE_DIMENSION", 4096)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	videoTypes := os.Getenv("ALLOWED_VIDEO_TYPES")
+	if videoTypes == "" {
+		videoTypes = "video/mp4,video/quicktime,video/webm,video/x-matroska,video/x-msvideo"
+	}
+	allowedVideoTypes, err := parseVideoTypes(videoTypes)
+	if err != nil {
+		log.Fatalf("Invalid ALLOWED_VIDEO_TYPES: %v", err)
+	}
+	keepSourceMaster, err := boolEnv("KEEP_SOURCE_MASTER", false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ladder := os.Getenv("RENDITIONS")
+	if ladder == "" {
+		ladder = "1080p,720p,480p,360p"
+	}
+	renditions, err := parseRenditions(ladder)
+	if err != nil {
+		log.Fatalf("Invalid RENDITIONS: %v", err)
+	}
+	formats, ok := os.LookupEnv("STREAMING_FORMATS")
+	if !ok {
+		formats = "hls"
+	}
+	streamFormats, err := parseStreamFormats(formats)
+	if err != nil {
+		log.Fatalf("Invalid STREAMING_FORMATS: %v", err)
+	}
+	if len(streamFormats) > 0 && len(renditions) == 0 {
+		log.Fatal("RENDITIONS must list at least one rendition when STREAMING_FORMATS is set")
+	}
+
+	quotaStorageMB, err := intEnv("QUOTA_STORAGE_MB", 10240)
+	if err != nil {
+		log.Fatal(err)
+	}
+	quotaMaxVideos, err := intEnv("QUOTA_MAX_VIDEOS", 100)
+	if err != nil {
+		log.Fatal(err)
+	}
+	quotaMaxVideoDuration, err := durationEnv("QUOTA_MAX_VIDEO_DURATION", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	adminAPIKey := os.Getenv("ADMIN_API_KEY")
+
+	gcInterval, err := durationEnv("GC_INTERVAL", 6*time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gcGracePeriod, err := durationEnv("GC_GRACE_PERIOD", 24*time.Hour)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Client:         bucketclient,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		db:                db,
+		jwtSecret:         jwtSecret,
+		platform:          platform,
+		filepathRoot:      filepathRoot,
+		assetsRoot:        assetsRoot,
+		s3Bucket:          s3Bucket,
+		s3Region:          s3Region,
+		s3CfDistribution:  s3CfDistribution,
+		store:             store,
+		cdnSigner:         cdnSigner,
+		cdnCookieDomain:   os.Getenv("CF_COOKIE_DOMAIN"),
+		cdnURLExpiry:      cdnURLExpiry,
+		uploadsDir:        uploadsDir,
+		uploadLocks:       newUploadLocks(),
+		jobWake:           make(chan struct{}, 1),
+		prober:            media.NewFFprobe(probeTimeout),
+		maxVideoDuration:  maxVideoDuration,
+		maxVideoDimension: maxVideoDimension,
+		maxImageDimension: maxImageDimension,
+		allowedVideoTypes: allowedVideoTypes,
+		keepSourceMaster:  keepSourceMaster,
+		renditions:        renditions,
+		streamFormats:     streamFormats,
+		defaultQuota: quota{
+			MaxBytes:                int64(quotaStorageMB) << 20,
+			MaxVideos:               quotaMaxVideos,
+			MaxVideoDurationSeconds: quotaMaxVideoDuration.Seconds(),
+		},
+		adminAPIKey:   adminAPIKey,
+		gcGracePeriod: gcGracePeriod,
+		port:          port,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -109,27 +302,49 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	go cfg.retryAssetDeletions(context.Background())
+	go cfg.runGC(context.Background(), gcInterval)
+	go cfg.expireUploads(context.Background())
+	cfg.runJobWorkers(context.Background(), videoWorkers)
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
 	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", NocacheMiddleware((assetsHandler)))
+	mux.Handle("/assets/", NocacheMiddleware(privateAssets(assetsHandler)))
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("GET /api/users/me/usage", cfg.handlerUsageGet)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	mux.HandleFunc("GET /api/thumbnails/{videoID}", cfg.handlerThumbnailGet)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("OPTIONS /api/uploads", cfg.handlerTusOptions)
+	mux.HandleFunc("POST /api/uploads", cfg.handlerTusCreate)
+	mux.HandleFunc("HEAD /api/uploads/{uploadID}", cfg.handlerTusHead)
+	mux.HandleFunc("PATCH /api/uploads/{uploadID}", cfg.handlerTusPatch)
+	mux.HandleFunc("DELETE /api/uploads/{uploadID}", cfg.handlerTusDelete)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("GET /api/videos/search", cfg.handlerVideosSearch)
+	mux.HandleFunc("GET /api/videos/{videoID}/cdn-cookies", cfg.handlerCDNCookies)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoMetaUpdate)
+	mux.HandleFunc("GET /api/videos/{videoID}/job", cfg.handlerVideoJobGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/stream", cfg.handlerVideoStream)
+	mux.HandleFunc("GET /api/videos/{videoID}/thumbnails", cfg.handlerThumbnailCandidatesGet)
+	mux.HandleFunc("PUT /api/videos/{videoID}/thumbnail", cfg.handlerThumbnailSelect)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("POST /admin/gc", cfg.handlerGC)
+	mux.HandleFunc("GET /admin/users/{userID}/quota", cfg.handlerAdminQuotaGet)
+	mux.HandleFunc("PUT /admin/users/{userID}/quota", cfg.handlerAdminQuotaPut)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
@@ -139,3 +354,42 @@ func main() {
 	log.Printf("Serving on: http://localhost:%s/app/\n", port)
 	log.Fatal(srv.ListenAndServe())
 }
+
+// durationEnv parses an optional duration variable like "6h", falling back to def.
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid duration: %w", name, err)
+	}
+	return d, nil
+}
+
+// intEnv parses an optional integer variable, falling back to def.
+func intEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid integer: %w", name, err)
+	}
+	return n, nil
+}
+
+// boolEnv parses an optional boolean variable like "true", falling back to def.
+func boolEnv(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s is not a valid boolean: %w", name, err)
+	}
+	return b, nil
+}
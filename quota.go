@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/auth"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+)
+
+// quota is what a user may store, 0 meaning no limit. Every user gets the
+// configured defaults unless an admin overrode them.
+type quota struct {
+	MaxBytes                int64   `json:"max_bytes"`
+	MaxVideos               int     `json:"max_videos"`
+	MaxVideoDurationSeconds float64 `json:"max_video_duration_seconds"`
+}
+
+type usageResponse struct {
+	database.UserUsage
+	Quota quota `json:"quota"`
+}
+
+func (cfg *apiConfig) userQuota(userID uuid.UUID) (quota, error) {
+	q := cfg.defaultQuota
+	override, err := cfg.db.GetUserQuota(userID)
+	if err != nil {
+		return quota{}, err
+	}
+	if override.MaxBytes != nil {
+		q.MaxBytes = *override.MaxBytes
+	}
+	if override.MaxVideos != nil {
+		q.MaxVideos = *override.MaxVideos
+	}
+	if override.MaxVideoDurationSeconds != nil {
+		q.MaxVideoDurationSeconds = *override.MaxVideoDurationSeconds
+	}
+	return q, nil
+}
+
+// storageLeft returns how many more bytes the user may store, along with
+// their quota.
+func (cfg *apiConfig) storageLeft(userID uuid.UUID) (int64, quota, error) {
+	q, err := cfg.userQuota(userID)
+	if err != nil {
+		return 0, quota{}, err
+	}
+	if q.MaxBytes <= 0 {
+		return math.MaxInt64, q, nil
+	}
+	usage, err := cfg.db.GetUserUsage(userID)
+	if err != nil {
+		return 0, quota{}, err
+	}
+	return max(q.MaxBytes-usage.Bytes-usage.ReservedBytes, 0), q, nil
+}
+
+// checkStorageCommitted fails when the user's stored and reserved bytes are
+// over their quota, which uploads racing each other past the checks above
+// can cause. Jobs check it before processing, counting their own source.
+func (cfg *apiConfig) checkStorageCommitted(userID uuid.UUID) error {
+	q, err := cfg.userQuota(userID)
+	if err != nil {
+		return err
+	}
+	if q.MaxBytes <= 0 {
+		return nil
+	}
+	usage, err := cfg.db.GetUserUsage(userID)
+	if err != nil {
+		return err
+	}
+	if usage.Bytes+usage.ReservedBytes > q.MaxBytes {
+		return errStorageQuota(max(q.MaxBytes-usage.Bytes, 0))
+	}
+	return nil
+}
+
+// errStorageQuota is the rejection for uploads that don't fit the user's
+// storage quota.
+func errStorageQuota(left int64) error {
+	return reject(http.StatusRequestEntityTooLarge, fmt.Sprintf("Quota exceeded: %d bytes of storage left", left), nil)
+}
+
+// checkVideoQuota rejects creating another video for a user at their limit.
+func (cfg *apiConfig) checkVideoQuota(userID uuid.UUID) error {
+	q, err := cfg.userQuota(userID)
+	if err != nil {
+		return err
+	}
+	if q.MaxVideos <= 0 {
+		return nil
+	}
+	usage, err := cfg.db.GetUserUsage(userID)
+	if err != nil {
+		return err
+	}
+	if usage.Videos >= q.MaxVideos {
+		return reject(http.StatusRequestEntityTooLarge, fmt.Sprintf("Quota exceeded: at most %d videos", q.MaxVideos), nil)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) usage(userID uuid.UUID) (usageResponse, error) {
+	q, err := cfg.userQuota(userID)
+	if err != nil {
+		return usageResponse{}, err
+	}
+	usage, err := cfg.db.GetUserUsage(userID)
+	if err != nil {
+		return usageResponse{}, err
+	}
+	return usageResponse{UserUsage: usage, Quota: q}, nil
+}
+
+func (cfg *apiConfig) handlerUsageGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	usage, err := cfg.usage(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get usage", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, usage)
+}
+
+func (cfg *apiConfig) handlerAdminQuotaGet(w http.ResponseWriter, r *http.Request) {
+	if !cfg.checkAdmin(w, r) {
+		return
+	}
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	usage, err := cfg.usage(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get usage", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, usage)
+}
+
+// handlerAdminQuotaPut replaces a user's quota overrides, a null or missing
+// field puts that limit back to the default.
+func (cfg *apiConfig) handlerAdminQuotaPut(w http.ResponseWriter, r *http.Request) {
+	if !cfg.checkAdmin(w, r) {
+		return
+	}
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	params := database.UserQuota{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if (params.MaxBytes != nil && *params.MaxBytes < 0) ||
+		(params.MaxVideos != nil && *params.MaxVideos < 0) ||
+		(params.MaxVideoDurationSeconds != nil && *params.MaxVideoDurationSeconds < 0) {
+		respondWithError(w, http.StatusBadRequest, "Quotas can't be negative, use 0 for no limit", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, "User not found", nil)
+		return
+	}
+
+	params.UserID = userID
+	err = cfg.db.UpsertUserQuota(params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update quota", err)
+		return
+	}
+
+	usage, err := cfg.usage(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get usage", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, usage)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// segmentSeconds is the segment length of both HLS and DASH output.
+const segmentSeconds = 6
+
+// rendition is one rung of the adaptive bitrate ladder.
+type rendition struct {
+	Height       int
+	VideoBitrate int // kbit/s
+	AudioBitrate int // kbit/s
+}
+
+// knownRenditions are the bitrates used for each supported ladder height.
+var knownRenditions = map[int]rendition{
+	2160: {Height: 2160, VideoBitrate: 14000, AudioBitrate: 192},
+	1440: {Height: 1440, VideoBitrate: 8000, AudioBitrate: 192},
+	1080: {Height: 1080, VideoBitrate: 5000, AudioBitrate: 128},
+	720:  {Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+	480:  {Height: 480, VideoBitrate: 1400, AudioBitrate: 96},
+	360:  {Height: 360, VideoBitrate: 800, AudioBitrate: 96},
+	240:  {Height: 240, VideoBitrate: 400, AudioBitrate: 64},
+}
+
+// parseRenditions reads a ladder like "1080p,720p,480p,360p".
+func parseRenditions(s string) ([]rendition, error) {
+	ladder := []rendition{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSuffix(strings.TrimSpace(field), "p")
+		if field == "" {
+			continue
+		}
+		height, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rendition %q", field)
+		}
+		r, ok := knownRenditions[height]
+		if !ok {
+			return nil, fmt.Errorf("unsupported rendition height %d", height)
+		}
+		ladder = append(ladder, r)
+	}
+	return ladder, nil
+}
+
+// renditionsFor drops rungs taller than the source, there is no point in
+// upscaling. The smallest rung is always kept so every video gets a stream.
+func renditionsFor(ladder []rendition, sourceHeight int) []rendition {
+	out := []rendition{}
+	smallest := -1
+	for i, r := range ladder {
+		if r.Height <= sourceHeight {
+			out = append(out, r)
+		}
+		if smallest == -1 || r.Height < ladder[smallest].Height {
+			smallest = i
+		}
+	}
+	if len(out) == 0 && smallest != -1 {
+		out = append(out, ladder[smallest])
+	}
+	return out
+}
+
+// encodeRenditions transcodes the source's video stream at index videoStream
+// and its first audio stream once per rung into H.264/AAC MP4
+// files in outDir and returns their paths in ladder order. Keyframes are
+// forced on segment boundaries so every packager cuts the renditions at the
+// same points and players can switch between them cleanly.
+func encodeRenditions(ctx context.Context, srcPath, outDir string, ladder []rendition, videoStream int, withAudio bool) ([]string, error) {
+	filter := fmt.Sprintf("[0:%d]split=%d", videoStream, len(ladder))
+	for i := range ladder {
+		filter += fmt.Sprintf("[v%d]", i)
+	}
+	for i, r := range ladder {
+		filter += fmt.Sprintf(";[v%d]scale=-2:%d[v%dout]", i, r.Height, i)
+	}
+
+	args := []string{"-y", "-i", srcPath, "-filter_complex", filter}
+	outputs := []string{}
+	for i, r := range ladder {
+		out := filepath.Join(outDir, fmt.Sprintf("%dp.mp4", r.Height))
+		args = append(args,
+			"-map", fmt.Sprintf("[v%dout]", i),
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-b:v", fmt.Sprintf("%dk", r.VideoBitrate),
+			"-maxrate", fmt.Sprintf("%dk", r.VideoBitrate*107/100),
+			"-bufsize", fmt.Sprintf("%dk", r.VideoBitrate*3/2),
+			"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentSeconds),
+		)
+		if withAudio {
+			args = append(args,
+				"-map", "0:a:0",
+				"-c:a", "aac",
+				"-b:a", fmt.Sprintf("%dk", r.AudioBitrate),
+			)
+		}
+		args = append(args, out)
+		outputs = append(outputs, out)
+	}
+
+	if err := runFFmpeg(ctx, args...); err != nil {
+		return nil, fmt.Errorf("ffmpeg encode failed: %w", err)
+	}
+	return outputs, nil
+}
+
+// runFFmpeg runs ffmpeg to completion, returning its stderr on failure.
+func runFFmpeg(ctx context.Context, args ...string) error {
+	v := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	v.Stderr = &stderr
+	if err := v.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// streamPrefix is where a video's packaged streams of one format live in
+// storage, next to the MP4: horizontal/abc.mp4 -> horizontal/abc/hls/
+func streamPrefix(videoKey, format string) string {
+	return strings.TrimSuffix(videoKey, path.Ext(videoKey)) + "/" + format + "/"
+}
+
+// uploadDir stores every file under dir at prefix+<relative path> and returns
+// the keys it wrote.
+func (cfg *apiConfig) uploadDir(ctx context.Context, dir, prefix string, contentType func(string) string) ([]string, error) {
+	keys := []string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := prefix + filepath.ToSlash(rel)
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := cfg.store.Put(ctx, key, f, contentType(key)); err != nil {
+			return fmt.Errorf("couldn't store %s: %w", key, err)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+	"github.com/gpr3211/boot-s3-course/internal/media"
+)
+
+// streamFormat is an adaptive streaming packaging of the rendition ladder.
+type streamFormat struct {
+	Name        string
+	Manifest    string // manifest file name, relative to the format's prefix
+	AssetKind   string
+	ContentType func(name string) string
+	Package     func(ctx context.Context, renditions []string, ladder []rendition, outDir string, withAudio bool) error
+}
+
+var streamFormats = map[string]streamFormat{
+	"hls": {
+		Name:        "hls",
+		Manifest:    "master.m3u8",
+		AssetKind:   database.AssetKindHLS,
+		ContentType: hlsContentType,
+		Package: func(ctx context.Context, renditions []string, _ []rendition, outDir string, withAudio bool) error {
+			return packageHLS(ctx, renditions, outDir, withAudio)
+		},
+	},
+	"dash": {
+		Name:        "dash",
+		Manifest:    "manifest.mpd",
+		AssetKind:   database.AssetKindDASH,
+		ContentType: dashContentType,
+		Package:     packageDASH,
+	},
+}
+
+// parseStreamFormats reads a list of packagings like "hls,dash".
+func parseStreamFormats(s string) ([]streamFormat, error) {
+	formats := []streamFormat{}
+	seen := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		f, ok := streamFormats[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown streaming format %q, expected hls or dash", name)
+		}
+		seen[name] = true
+		formats = append(formats, f)
+	}
+	return formats, nil
+}
+
+// transcodeStreams encodes the rendition ladder once and packages it in every
+// configured format, each under workDir/<format>.
+func (cfg *apiConfig) transcodeStreams(ctx context.Context, srcPath, workDir string, probe media.Probe) error {
+	renditionDir := filepath.Join(workDir, "renditions")
+	if err := os.Mkdir(renditionDir, 0755); err != nil {
+		return err
+	}
+	video, err := probe.VideoStream()
+	if err != nil {
+		return err
+	}
+	// ffmpeg applies the rotation while scaling, so the ladder is matched
+	// against the displayed height
+	_, height := video.DisplaySize()
+	ladder := renditionsFor(cfg.renditions, height)
+	_, withAudio := probe.AudioStream()
+	renditions, err := encodeRenditions(ctx, srcPath, renditionDir, ladder, video.Index, withAudio)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range cfg.streamFormats {
+		outDir := filepath.Join(workDir, f.Name)
+		if err := os.Mkdir(outDir, 0755); err != nil {
+			return err
+		}
+		if err := f.Package(ctx, renditions, ladder, outDir, withAudio); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadStreams stores the packaged streams next to the video's MP4, records
+// every file as an asset of the video and returns the manifest key of each
+// format.
+func (cfg *apiConfig) uploadStreams(ctx context.Context, videoID uuid.UUID, workDir, videoKey string) (map[string]string, error) {
+	manifests := map[string]string{}
+	for _, f := range cfg.streamFormats {
+		prefix := streamPrefix(videoKey, f.Name)
+		keys, err := cfg.uploadDir(ctx, filepath.Join(workDir, f.Name), prefix, f.ContentType)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't upload %s stream: %w", f.Name, err)
+		}
+		for _, key := range keys {
+			err = cfg.db.CreateVideoAsset(videoID, key, f.AssetKind)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't record %s asset: %w", f.Name, err)
+			}
+		}
+		manifests[f.Name] = prefix + f.Manifest
+	}
+	return manifests, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+	"github.com/gpr3211/boot-s3-course/internal/media"
+)
+
+// thumbnailWidths are the widths, in pixels, thumbnails are resized to.
+var thumbnailWidths = []int{160, 320, 640, 1280}
+
+// thumbnailFormats maps variant formats to their file extension.
+var thumbnailFormats = map[string]string{
+	"webp": ".webp",
+	"jpeg": ".jpg",
+}
+
+// variantPrefix is where the resized copies of a thumbnail live:
+// abc.png -> abc/
+func variantPrefix(thumbnailKey string) string {
+	return derivedPrefix(thumbnailKey)
+}
+
+// orientationFilters turn a picture upright for each EXIF orientation.
+var orientationFilters = map[int]string{
+	2: "hflip",
+	3: "hflip,vflip",
+	4: "vflip",
+	5: "transpose=cclock_flip",
+	6: "transpose=clock",
+	7: "transpose=clock_flip",
+	8: "transpose=cclock",
+}
+
+// generateThumbnailVariants writes <width>.webp and <width>.jpg to outDir for
+// every thumbnail width up to the source's own, at least the smallest. The
+// encoders write no metadata, so the pixels are turned upright first.
+func generateThumbnailVariants(ctx context.Context, srcPath, outDir string) error {
+	data, err := os.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("couldn't read thumbnail size: %w", err)
+	}
+	orientation := media.JPEGOrientation(data)
+	uprightWidth := config.Width
+	if orientation >= 5 {
+		uprightWidth = config.Height
+	}
+
+	for i, width := range thumbnailWidths {
+		if i > 0 && width > uprightWidth {
+			break
+		}
+		scale := fmt.Sprintf("scale=%d:-2", width)
+		if filter, ok := orientationFilters[orientation]; ok {
+			scale = filter + "," + scale
+		}
+		err := runFFmpeg(ctx,
+			"-y",
+			// rotated by the filter above, whatever ffmpeg makes of EXIF
+			"-noautorotate",
+			"-i", srcPath,
+			"-map_metadata", "-1",
+			"-vf", scale, "-frames:v", "1", "-c:v", "libwebp", "-quality", "80",
+			filepath.Join(outDir, strconv.Itoa(width)+thumbnailFormats["webp"]),
+			"-vf", scale, "-frames:v", "1", "-q:v", "4",
+			filepath.Join(outDir, strconv.Itoa(width)+thumbnailFormats["jpeg"]),
+		)
+		if err != nil {
+			return fmt.Errorf("ffmpeg thumbnail resize failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// storeThumbnailVariants resizes the thumbnail stored at key, read locally
+// from srcPath, and stores the variants under variantPrefix(key).
+func (cfg *apiConfig) storeThumbnailVariants(ctx context.Context, videoID uuid.UUID, srcPath, key string) (database.ThumbnailVariants, error) {
+	dir, err := os.MkdirTemp("", "variants-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := generateThumbnailVariants(ctx, srcPath, dir); err != nil {
+		return nil, err
+	}
+	prefix := variantPrefix(key)
+	keys, err := cfg.uploadDir(ctx, dir, prefix, func(name string) string {
+		if path.Ext(name) == ".webp" {
+			return "image/webp"
+		}
+		return "image/jpeg"
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't upload thumbnail variants: %w", err)
+	}
+	for _, k := range keys {
+		err = cfg.db.CreateVideoAsset(videoID, k, database.AssetKindThumbnailVariant)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't record thumbnail variant: %w", err)
+		}
+	}
+	return variantsFromKeys(prefix, keys), nil
+}
+
+// thumbnailVariants looks up the stored variants of a thumbnail, nil if it
+// has none.
+func (cfg *apiConfig) thumbnailVariants(key string) (database.ThumbnailVariants, error) {
+	prefix := variantPrefix(key)
+	assets, err := cfg.db.GetVideoAssetsWithPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for _, a := range assets {
+		if a.Kind == database.AssetKindThumbnailVariant {
+			keys = append(keys, a.Key)
+		}
+	}
+	return variantsFromKeys(prefix, keys), nil
+}
+
+// variantsFromKeys sorts keys named <prefix><width>.<ext> by format and width.
+func variantsFromKeys(prefix string, keys []string) database.ThumbnailVariants {
+	var variants database.ThumbnailVariants
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		ext := path.Ext(name)
+		width, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+		if err != nil {
+			continue
+		}
+		for format, formatExt := range thumbnailFormats {
+			if ext != formatExt {
+				continue
+			}
+			if variants == nil {
+				variants = database.ThumbnailVariants{}
+			}
+			if variants[format] == nil {
+				variants[format] = map[int]string{}
+			}
+			variants[format][width] = key
+		}
+	}
+	return variants
+}
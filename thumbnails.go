@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+)
+
+// thumbnailPositions are the points of the video, as fractions of its
+// duration, candidate thumbnails are taken from.
+var thumbnailPositions = []float64{0.1, 0.25, 0.5, 0.75, 0.9}
+
+// defaultThumbnail is the candidate picked when the owner hasn't chosen one.
+const defaultThumbnail = 2
+
+// extractThumbnails writes one JPEG per thumbnail position to outDir. Each
+// frame is the most representative one, per ffmpeg's thumbnail filter, of the
+// few seconds after its position, which skips over fades and black frames.
+func extractThumbnails(ctx context.Context, srcPath, outDir string, duration float64) error {
+	positions := thumbnailPositions
+	if duration <= 0 {
+		positions = []float64{0}
+	}
+	for i, p := range positions {
+		out := filepath.Join(outDir, fmt.Sprintf("candidate_%02d.jpg", i))
+		err := runFFmpeg(ctx,
+			"-y",
+			"-ss", strconv.FormatFloat(duration*p, 'f', 3, 64),
+			"-i", srcPath,
+			"-vf", "thumbnail=50",
+			"-frames:v", "1",
+			"-q:v", "3",
+			out)
+		if err != nil {
+			return fmt.Errorf("ffmpeg thumbnail failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// uploadThumbnailCandidates stores the extracted frames, and their resized
+// variants, next to the video's MP4 and returns their keys in position order
+// along with the variants of each.
+func (cfg *apiConfig) uploadThumbnailCandidates(ctx context.Context, videoID uuid.UUID, dir, videoKey string) ([]string, map[string]database.ThumbnailVariants, error) {
+	keys, err := cfg.uploadDir(ctx, dir, streamPrefix(videoKey, "thumbnails"), func(string) string {
+		return "image/jpeg"
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("couldn't upload thumbnail candidates: %w", err)
+	}
+	variants := map[string]database.ThumbnailVariants{}
+	for _, key := range keys {
+		err = cfg.db.CreateVideoAsset(videoID, key, database.AssetKindThumbnailCandidate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't record thumbnail candidate: %w", err)
+		}
+		variants[key], err = cfg.storeThumbnailVariants(ctx, videoID, filepath.Join(dir, path.Base(key)), key)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return keys, variants, nil
+}
+
+// releaseThumbnail releases a replaced thumbnail and its variants unless it is one of the
+// video's candidates, those stay available to pick again.
+func (cfg *apiConfig) releaseThumbnail(videoID uuid.UUID, key string) {
+	candidates, err := cfg.db.GetVideoAssetsByKind(videoID, database.AssetKindThumbnailCandidate)
+	if err != nil {
+		log.Printf("Couldn't get thumbnail candidates of %s: %v", videoID, err)
+		return
+	}
+	for _, c := range candidates {
+		if c.Key == key {
+			return
+		}
+	}
+	cfg.releaseBlob(videoID, key)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gpr3211/boot-s3-course/internal/media"
+)
+
+// uploadRejection is an upload that was received fine but can't be accepted,
+// with the status and message to answer with.
+type uploadRejection struct {
+	status int
+	msg    string
+	err    error
+}
+
+func (e *uploadRejection) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+func (e *uploadRejection) Unwrap() error {
+	return e.err
+}
+
+func reject(status int, msg string, err error) error {
+	return &uploadRejection{status: status, msg: msg, err: err}
+}
+
+// respondWithUploadError answers with the rejection's status, or 500 for
+// anything else.
+func respondWithUploadError(w http.ResponseWriter, msg string, err error) {
+	var rej *uploadRejection
+	if errors.As(err, &rej) {
+		respondWithError(w, rej.status, rej.msg, rej.err)
+		return
+	}
+	respondWithError(w, http.StatusInternalServerError, msg, err)
+}
+
+// sniffError turns a sniffing failure into the rejection clients see.
+func sniffError(err error) error {
+	switch {
+	case errors.Is(err, media.ErrPolyglot):
+		return reject(http.StatusUnsupportedMediaType, "File contains data that doesn't belong to its format", err)
+	case errors.Is(err, media.ErrUnknownFormat):
+		return reject(http.StatusUnsupportedMediaType, "File content is not a supported format", err)
+	default:
+		return err
+	}
+}
+
+// validateVideo checks the uploaded file at path really is a video of the
+// declared type that ffprobe can decode, within the configured limits and the
+// uploader's quota, and returns its actual type.
+func (cfg *apiConfig) validateVideo(ctx context.Context, path, declaredType string, q quota) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	mediaType, err := media.SniffVideo(f, info.Size())
+	if err != nil {
+		return "", sniffError(err)
+	}
+	if !media.SameContainerFamily(mediaType, declaredType) {
+		return "", reject(http.StatusUnsupportedMediaType, fmt.Sprintf("File content is %s, not %s", mediaType, declaredType), nil)
+	}
+	if !cfg.allowedVideoTypes[mediaType] {
+		return "", reject(http.StatusUnsupportedMediaType, fmt.Sprintf("Video format %s is not accepted", mediaType), nil)
+	}
+
+	probe, err := cfg.prober.Probe(ctx, path)
+	if err != nil {
+		return "", reject(http.StatusUnsupportedMediaType, "Couldn't decode video", err)
+	}
+	stream, err := probe.VideoStream()
+	if err != nil {
+		return "", reject(http.StatusUnsupportedMediaType, "File has no video stream", err)
+	}
+	if cfg.maxVideoDimension > 0 && max(stream.Width, stream.Height) > cfg.maxVideoDimension {
+		return "", reject(http.StatusUnprocessableEntity,
+			fmt.Sprintf("Video is %dx%d, the maximum is %d pixels per side", stream.Width, stream.Height, cfg.maxVideoDimension), nil)
+	}
+	if cfg.maxVideoDuration > 0 && probe.Duration() > cfg.maxVideoDuration.Seconds() {
+		return "", reject(http.StatusUnprocessableEntity,
+			fmt.Sprintf("Video is longer than the maximum of %s", cfg.maxVideoDuration), nil)
+	}
+	if q.MaxVideoDurationSeconds > 0 && probe.Duration() > q.MaxVideoDurationSeconds {
+		return "", reject(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Quota exceeded: videos can be at most %s long", time.Duration(q.MaxVideoDurationSeconds*float64(time.Second))), nil)
+	}
+	return mediaType, nil
+}
+
+// validateImage checks data really is an image of the declared type within
+// the configured limits.
+func (cfg *apiConfig) validateImage(data []byte, declaredType string) error {
+	mediaType, config, err := media.SniffImage(data)
+	if err != nil {
+		return sniffError(err)
+	}
+	if mediaType != declaredType {
+		return reject(http.StatusUnsupportedMediaType, fmt.Sprintf("File content is %s, not %s", mediaType, declaredType), nil)
+	}
+	if cfg.maxImageDimension > 0 && max(config.Width, config.Height) > cfg.maxImageDimension {
+		return reject(http.StatusUnprocessableEntity,
+			fmt.Sprintf("Image is %dx%d, the maximum is %d pixels per side", config.Width, config.Height, cfg.maxImageDimension), nil)
+	}
+	return nil
+}
+
+// parseVideoTypes reads an allowlist like "video/mp4,video/webm".
+func parseVideoTypes(s string) (map[string]bool, error) {
+	known := []string{media.TypeMP4, media.TypeQuickTime, media.TypeWebM, media.TypeMatroska, media.TypeAVI}
+	types := map[string]bool{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		if !slices.Contains(known, t) {
+			return nil, fmt.Errorf("unsupported video type %q", t)
+		}
+		types[t] = true
+	}
+	if len(types) == 0 {
+		return nil, errors.New("no video types allowed")
+	}
+	return types, nil
+}
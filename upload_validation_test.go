@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gpr3211/boot-s3-course/internal/media"
+)
+
+func TestValidateVideo(t *testing.T) {
+	withStreams := func(streams ...media.Stream) *media.Probe {
+		p := hdProbe
+		p.Streams = streams
+		return &p
+	}
+	withDuration := func(seconds float64) *media.Probe {
+		p := hdProbe
+		p.Format.Duration = seconds
+		return &p
+	}
+	mp4 := writeMP4(t)
+	text := filepath.Join(t.TempDir(), "notes.mp4")
+	if err := os.WriteFile(text, []byte("not a video at all, just text"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		path         string
+		declared     string
+		prober       *media.Fake
+		maxDimension int
+		maxDuration  time.Duration
+		q            quota
+		want         string
+		wantStatus   int
+	}{
+		{name: "mp4", path: mp4, declared: media.TypeMP4, prober: &media.Fake{Default: &hdProbe}, want: media.TypeMP4},
+		{name: "mp4 declared as quicktime", path: mp4, declared: media.TypeQuickTime, prober: &media.Fake{Default: &hdProbe}, want: media.TypeMP4},
+		{name: "within the limits", path: mp4, declared: media.TypeMP4, prober: &media.Fake{Default: &hdProbe}, maxDimension: 1920, maxDuration: 10 * time.Second, q: quota{MaxVideoDurationSeconds: 10}, want: media.TypeMP4},
+		{name: "not a video", path: text, declared: media.TypeMP4, prober: &media.Fake{Default: &hdProbe}, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "mp4 declared as webm", path: mp4, declared: media.TypeWebM, prober: &media.Fake{Default: &hdProbe}, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "probe fails", path: mp4, declared: media.TypeMP4, prober: &media.Fake{Err: errors.New("invalid data")}, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "cover art only", path: mp4, declared: media.TypeMP4, prober: &media.Fake{Default: withStreams(media.Stream{CodecType: "video", CodecName: "mjpeg", Width: 300, Height: 300})}, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "too large", path: mp4, declared: media.TypeMP4, prober: &media.Fake{Default: &hdProbe}, maxDimension: 1280, wantStatus: http.StatusUnprocessableEntity},
+		{name: "too long", path: mp4, declared: media.TypeMP4, prober: &media.Fake{Default: withDuration(601)}, maxDuration: 10 * time.Minute, wantStatus: http.StatusUnprocessableEntity},
+		{name: "over the duration quota", path: mp4, declared: media.TypeMP4, prober: &media.Fake{Default: withDuration(61)}, q: quota{MaxVideoDurationSeconds: 60}, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newTestConfig(t, tt.prober)
+			cfg.maxVideoDimension = tt.maxDimension
+			cfg.maxVideoDuration = tt.maxDuration
+
+			got, err := cfg.validateVideo(context.Background(), tt.path, tt.declared, tt.q)
+			if tt.wantStatus == 0 {
+				if err != nil {
+					t.Fatalf("validateVideo() error = %v", err)
+				}
+				if got != tt.want {
+					t.Errorf("validateVideo() = %q, want %q", got, tt.want)
+				}
+				return
+			}
+			var rej *uploadRejection
+			if !errors.As(err, &rej) {
+				t.Fatalf("validateVideo() error = %v, want a rejection", err)
+			}
+			if rej.status != tt.wantStatus {
+				t.Errorf("rejection status = %d, want %d (%v)", rej.status, tt.wantStatus, err)
+			}
+		})
+	}
+}
+
+func TestValidateVideoNotAllowed(t *testing.T) {
+	cfg := newTestConfig(t, &media.Fake{Default: &hdProbe})
+	cfg.allowedVideoTypes = map[string]bool{media.TypeWebM: true}
+
+	_, err := cfg.validateVideo(context.Background(), writeMP4(t), media.TypeMP4, quota{})
+	var rej *uploadRejection
+	if !errors.As(err, &rej) || rej.status != http.StatusUnsupportedMediaType {
+		t.Errorf("validateVideo() error = %v, want a 415 rejection", err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gpr3211/boot-s3-course/internal/database"
+	"github.com/gpr3211/boot-s3-course/internal/media"
+)
+
+const (
+	defaultVideosPageSize = 20
+	maxVideosPageSize     = 100
+)
+
+// videosPage is the response of GET /api/videos. NextCursor is passed back
+// as ?cursor= for the following page and is null on the last one.
+type videosPage struct {
+	Videos     []database.Video `json:"videos"`
+	NextCursor *string          `json:"next_cursor"`
+}
+
+// pageCursor is what a cursor encodes. The listing order is part of it so a
+// cursor can't be used to continue a different listing.
+type pageCursor struct {
+	Sort      database.VideoSort `json:"s"`
+	Ascending bool               `json:"a,omitempty"`
+	database.VideoCursor
+}
+
+// parseVideosQuery reads the paging, sorting and filtering options of
+// GET /api/videos. Without options it returns the newest videos first.
+func parseVideosQuery(q url.Values) (database.ListVideosParams, error) {
+	params := database.ListVideosParams{
+		Sort:  database.VideoSortCreated,
+		Limit: defaultVideosPageSize,
+	}
+
+	if s := q.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxVideosPageSize {
+			return params, fmt.Errorf("limit must be between 1 and %d", maxVideosPageSize)
+		}
+		params.Limit = limit
+	}
+
+	if s := q.Get("sort"); s != "" {
+		params.Sort = database.VideoSort(s)
+		if !params.Sort.Valid() {
+			return params, fmt.Errorf("can't sort by %q", s)
+		}
+	}
+	// titles read naturally A to Z, everything else newest or longest first
+	params.Ascending = params.Sort == database.VideoSortTitle
+	switch q.Get("order") {
+	case "":
+	case "asc":
+		params.Ascending = true
+	case "desc":
+		params.Ascending = false
+	default:
+		return params, fmt.Errorf("order must be asc or desc")
+	}
+
+	var err error
+	params.HasVideo, err = parseBoolParam(q, "has_video")
+	if err != nil {
+		return params, err
+	}
+	params.HasThumbnail, err = parseBoolParam(q, "has_thumbnail")
+	if err != nil {
+		return params, err
+	}
+	if s := q.Get("orientation"); s != "" {
+		switch media.Orientation(s) {
+		case media.OrientationLandscape, media.OrientationPortrait, media.OrientationSquare:
+			params.Orientation = s
+		default:
+			return params, fmt.Errorf("unknown orientation %q", s)
+		}
+	}
+	params.CreatedFrom, err = parseTimeParam(q, "created_after")
+	if err != nil {
+		return params, err
+	}
+	params.CreatedTo, err = parseTimeParam(q, "created_before")
+	if err != nil {
+		return params, err
+	}
+
+	if s := q.Get("cursor"); s != "" {
+		params.After, err = decodeCursor(s, params.Sort, params.Ascending)
+		if err != nil {
+			return params, err
+		}
+	}
+	return params, nil
+}
+
+func parseBoolParam(q url.Values, name string) (*bool, error) {
+	s := q.Get(name)
+	if s == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true or false", name)
+	}
+	return &b, nil
+}
+
+func parseTimeParam(q url.Values, name string) (*time.Time, error) {
+	s := q.Get(name)
+	if s == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+	return &t, nil
+}
+
+func encodeCursor(c *database.VideoCursor, sort database.VideoSort, ascending bool) (*string, error) {
+	if c == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(pageCursor{Sort: sort, Ascending: ascending, VideoCursor: *c})
+	if err != nil {
+		return nil, err
+	}
+	s := base64.RawURLEncoding.EncodeToString(data)
+	return &s, nil
+}
+
+func decodeCursor(s string, sort database.VideoSort, ascending bool) (*database.VideoCursor, error) {
+	errInvalid := fmt.Errorf("invalid cursor")
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalid
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errInvalid
+	}
+	if c.Sort != sort || c.Ascending != ascending {
+		return nil, fmt.Errorf("cursor belongs to a listing with a different order")
+	}
+	// only values the listing could have produced are passed to SQL
+	switch c.Value.(type) {
+	case float64:
+		if sort != database.VideoSortDuration {
+			return nil, errInvalid
+		}
+	case string:
+		if sort == database.VideoSortDuration {
+			return nil, errInvalid
+		}
+	default:
+		return nil, errInvalid
+	}
+	return &c.VideoCursor, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	id := uuid.New()
+	tests := []struct {
+		name      string
+		cursor    database.VideoCursor
+		sort      database.VideoSort
+		ascending bool
+	}{
+		{"created", database.VideoCursor{Value: "2024-05-01 10:00:00.123", ID: id}, database.VideoSortCreated, false},
+		{"updated ascending", database.VideoCursor{Value: "2024-05-01 10:00:00.000", ID: id}, database.VideoSortUpdated, true},
+		{"title", database.VideoCursor{Value: "Ünïcode & \"quotes\"", ID: id}, database.VideoSortTitle, true},
+		{"duration", database.VideoCursor{Value: 93.25, ID: id}, database.VideoSortDuration, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := encodeCursor(&tt.cursor, tt.sort, tt.ascending)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if url.QueryEscape(*s) != *s {
+				t.Errorf("cursor %q needs escaping in a query string", *s)
+			}
+			got, err := decodeCursor(*s, tt.sort, tt.ascending)
+			if err != nil {
+				t.Fatalf("decodeCursor() error = %v", err)
+			}
+			if got.Value != tt.cursor.Value || got.ID != tt.cursor.ID {
+				t.Errorf("decodeCursor() = %+v, want %+v", *got, tt.cursor)
+			}
+		})
+	}
+
+	if s, err := encodeCursor(nil, database.VideoSortCreated, false); s != nil || err != nil {
+		t.Errorf("encodeCursor(nil) = %v, %v, want nil", s, err)
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	id := uuid.New()
+	encode := func(c database.VideoCursor, sort database.VideoSort, ascending bool) string {
+		s, err := encodeCursor(&c, sort, ascending)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *s
+	}
+	raw := func(json string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(json))
+	}
+	created := encode(database.VideoCursor{Value: "2024-05-01 10:00:00.000", ID: id}, database.VideoSortCreated, false)
+
+	tests := []struct {
+		name      string
+		cursor    string
+		sort      database.VideoSort
+		ascending bool
+	}{
+		{"other sort", created, database.VideoSortTitle, false},
+		{"other order", created, database.VideoSortCreated, true},
+		{"not base64", "not*base64", database.VideoSortCreated, false},
+		{"padded base64", base64.URLEncoding.EncodeToString([]byte(`{"s":"created","v":"x"}`)), database.VideoSortCreated, false},
+		{"not json", raw("created"), database.VideoSortCreated, false},
+		{"number for a timestamp", raw(`{"s":"created","v":1714557600,"id":"` + id.String() + `"}`), database.VideoSortCreated, false},
+		{"string for a duration", raw(`{"s":"duration","v":"1 OR 1=1","id":"` + id.String() + `"}`), database.VideoSortDuration, false},
+		{"object value", raw(`{"s":"title","a":true,"v":{"x":1},"id":"` + id.String() + `"}`), database.VideoSortTitle, true},
+		{"no value", raw(`{"s":"created","id":"` + id.String() + `"}`), database.VideoSortCreated, false},
+		{"bad id", raw(`{"s":"created","v":"x","id":"nope"}`), database.VideoSortCreated, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := decodeCursor(tt.cursor, tt.sort, tt.ascending); err == nil {
+				t.Errorf("decodeCursor() = %+v, want an error", *got)
+			}
+		})
+	}
+}
+
+func TestParseVideosQueryCursor(t *testing.T) {
+	cursor, err := encodeCursor(&database.VideoCursor{Value: "alpha", ID: uuid.New()}, database.VideoSortTitle, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// titles default to ascending, so the cursor continues that listing
+	params, err := parseVideosQuery(url.Values{"sort": {"title"}, "cursor": {*cursor}})
+	if err != nil {
+		t.Fatalf("parseVideosQuery() error = %v", err)
+	}
+	if params.After == nil || params.After.Value != "alpha" {
+		t.Errorf("parseVideosQuery() After = %+v, want the cursor", params.After)
+	}
+
+	_, err = parseVideosQuery(url.Values{"sort": {"title"}, "order": {"desc"}, "cursor": {*cursor}})
+	if err == nil {
+		t.Error("parseVideosQuery() accepted a cursor of another order")
+	}
+}
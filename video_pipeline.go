@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+	"github.com/gpr3211/boot-s3-course/internal/media"
+)
+
+const maxVideoUploadSize = 1 << 30 // 1 GB size limit
+
+// processedVideo is what the pipeline stored for a video: the metadata of the
+// MP4, the streaming manifests by format and the candidate thumbnails with
+// their variants.
+type processedVideo struct {
+	meta              database.VideoMedia
+	manifests         map[string]string
+	candidates        []string
+	candidateVariants map[string]database.ThumbnailVariants
+}
+
+// processVideo runs an uploaded file through the media pipeline: probe it,
+// transcode the rendition ladder into the configured streaming formats,
+// extract candidate thumbnails, normalise the original to an H.264/AAC MP4
+// for streaming playback while uploading it to storage and point the video at
+// the results. The MP4 is stored under the SHA-256 of the upload, sum, and an
+// upload already processed for another video is shared instead of processed
+// again. progress is told about each job status the pipeline enters.
+// srcPath is left in place, the caller owns it.
+func (cfg *apiConfig) processVideo(ctx context.Context, video database.Video, srcPath, mediaType, sum string, progress func(status string)) error {
+	if err := cfg.checkStorageCommitted(video.UserID); err != nil {
+		return err
+	}
+
+	progress(database.JobStatusProbing)
+	probe, err := cfg.prober.Probe(ctx, srcPath)
+	if err != nil {
+		return fmt.Errorf("couldn't probe video: %w", err)
+	}
+	stream, err := probe.VideoStream()
+	if err != nil {
+		return fmt.Errorf("couldn't probe video: %w", err)
+	}
+
+	plan, err := planStreaming(probe)
+	if err != nil {
+		return fmt.Errorf("couldn't probe video: %w", err)
+	}
+
+	// jobs queued before uploads were hashed
+	if sum == "" {
+		sum, err = hashFile(srcPath)
+		if err != nil {
+			return fmt.Errorf("couldn't hash video: %w", err)
+		}
+	}
+
+	// every source is served as MP4 whatever it was uploaded as
+	shape, _ := stream.Classify()
+	finalPath := SetAspectPrefix(contentKey(sum, "video/mp4"), shape.Orientation)
+	oldKey := cfg.storedKey(video.VideoKey, video.VideoURL)
+
+	var out processedVideo
+	shared := false
+	if finalPath != oldKey {
+		err = cfg.reclaimBlob(finalPath)
+		if err != nil {
+			return fmt.Errorf("couldn't reclaim stored video: %w", err)
+		}
+		out, shared, err = cfg.shareProcessedVideo(video.ID, finalPath)
+		if err != nil {
+			return fmt.Errorf("couldn't share stored video: %w", err)
+		}
+	}
+	if !shared {
+		out, err = cfg.produceVideo(ctx, video.ID, srcPath, mediaType, finalPath, probe, plan, progress)
+		if err != nil {
+			return err
+		}
+	}
+
+	oldCandidates := ""
+	if oldKey != "" {
+		oldCandidates = streamPrefix(oldKey, "thumbnails")
+	}
+	// a thumbnail the owner uploaded is kept, a picked candidate belongs to
+	// the replaced video and moves to the new default
+	thumbKey := cfg.storedKey(video.ThumbnailKey, video.ThumbnailURL)
+	uploaded := thumbKey != "" || video.ThumbnailURL != nil
+	if !uploaded || (oldCandidates != "" && strings.HasPrefix(thumbKey, oldCandidates)) {
+		if len(out.candidates) == 0 {
+			return errors.New("no thumbnail candidates were extracted")
+		}
+		def := out.candidates[min(defaultThumbnail, len(out.candidates)-1)]
+		video.ThumbnailKey = &def
+		video.ThumbnailVariantKeys = out.candidateVariants[def]
+		video.ThumbnailURL = nil
+	}
+	video.VideoKey = &finalPath
+	video.VideoURL = nil
+	video.SourceMediaType = &mediaType
+	video.Orientation = nilIfEmpty(string(shape.Orientation))
+	video.AspectRatio = nilIfEmpty(shape.AspectRatio)
+	video.HLSKey = manifestKey(out.manifests, "hls")
+	video.DASHKey = manifestKey(out.manifests, "dash")
+	if finalPath != oldKey {
+		_, err = cfg.db.AcquireBlob(finalPath, sum, out.meta.SizeBytes)
+		if err != nil {
+			return fmt.Errorf("couldn't record video blob: %w", err)
+		}
+		if !shared {
+			cfg.recordDerivedSize(ctx, finalPath)
+		}
+	}
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		if finalPath != oldKey {
+			cfg.releaseBlob(video.ID, finalPath)
+		}
+		return fmt.Errorf("couldn't update video: %w", err)
+	}
+	err = cfg.db.UpsertVideoMedia(video.ID, out.meta)
+	if err != nil {
+		return fmt.Errorf("couldn't save video metadata: %w", err)
+	}
+	// renditions, candidates and the source master live under the old key
+	if finalPath != oldKey {
+		cfg.releaseBlob(video.ID, oldKey)
+	}
+	return nil
+}
+
+// produceVideo does the processing and stores the results under finalPath.
+func (cfg *apiConfig) produceVideo(ctx context.Context, videoID uuid.UUID, srcPath, mediaType, finalPath string, probe media.Probe, plan streamingPlan, progress func(status string)) (processedVideo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	progress(database.JobStatusTranscoding)
+	streamsDir := ""
+	if len(cfg.streamFormats) > 0 {
+		var err error
+		streamsDir, err = os.MkdirTemp("", "streams-*")
+		if err != nil {
+			return processedVideo{}, err
+		}
+		defer os.RemoveAll(streamsDir)
+
+		err = cfg.transcodeStreams(ctx, srcPath, streamsDir, probe)
+		if err != nil {
+			return processedVideo{}, fmt.Errorf("couldn't transcode renditions: %w", err)
+		}
+	}
+
+	thumbsDir, err := os.MkdirTemp("", "thumbnails-*")
+	if err != nil {
+		return processedVideo{}, err
+	}
+	defer os.RemoveAll(thumbsDir)
+	err = extractThumbnails(ctx, srcPath, thumbsDir, probe.Duration())
+	if err != nil {
+		return processedVideo{}, fmt.Errorf("couldn't extract thumbnails: %w", err)
+	}
+
+	// ffmpeg streams straight into storage, there is no processed copy on disk
+	processed, err := normalizeForStreaming(ctx, srcPath, plan)
+	if err != nil {
+		return processedVideo{}, fmt.Errorf("couldn't process video: %w", err)
+	}
+	progress(database.JobStatusUploading)
+	// hashed on the way so viewers can verify what they download
+	sum := sha256.New()
+	err = cfg.store.Put(ctx, finalPath, io.TeeReader(processed, sum), "video/mp4")
+	if err != nil {
+		cancel()
+		processed.Close()
+		return processedVideo{}, fmt.Errorf("couldn't upload video: %w", err)
+	}
+	if err := processed.Close(); err != nil {
+		// the stored object is truncated, don't keep it around
+		if delErr := cfg.store.Delete(ctx, finalPath); delErr != nil {
+			log.Printf("Couldn't delete incomplete video %s: %v", finalPath, delErr)
+		}
+		return processedVideo{}, fmt.Errorf("couldn't process video: %w", err)
+	}
+
+	out := processedVideo{meta: mediaFromProbe(probe), manifests: map[string]string{}}
+	plan.applyTo(&out.meta)
+	out.meta.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	// the processed file is what viewers download, not the upload
+	if info, err := cfg.store.Stat(ctx, finalPath); err == nil {
+		out.meta.SizeBytes = info.Size
+	}
+
+	err = cfg.db.CreateVideoAsset(videoID, finalPath, database.AssetKindVideo)
+	if err != nil {
+		return processedVideo{}, fmt.Errorf("couldn't record video asset: %w", err)
+	}
+
+	if streamsDir != "" {
+		out.manifests, err = cfg.uploadStreams(ctx, videoID, streamsDir, finalPath)
+		if err != nil {
+			return processedVideo{}, err
+		}
+	}
+
+	out.candidates, out.candidateVariants, err = cfg.uploadThumbnailCandidates(ctx, videoID, thumbsDir, finalPath)
+	if err != nil {
+		return processedVideo{}, err
+	}
+	// ffmpeg exits cleanly without writing a frame for some broken inputs
+	if len(out.candidates) == 0 {
+		return processedVideo{}, errors.New("couldn't extract thumbnails: no frames written")
+	}
+
+	if cfg.keepSourceMaster {
+		err = cfg.uploadSourceMaster(ctx, videoID, srcPath, mediaType, finalPath)
+		if err != nil {
+			return processedVideo{}, err
+		}
+	}
+	return out, nil
+}
+
+// shareProcessedVideo makes what the pipeline stored at key for another video
+// assets of videoID as well. It reports false when no other video uses key.
+func (cfg *apiConfig) shareProcessedVideo(videoID uuid.UUID, key string) (processedVideo, bool, error) {
+	otherID, err := cfg.db.GetVideoIDWithKey(key, videoID)
+	if err != nil || otherID == uuid.Nil {
+		return processedVideo{}, false, err
+	}
+	other, err := cfg.db.GetVideo(otherID)
+	if err != nil {
+		return processedVideo{}, false, err
+	}
+	// deleted or replaced in the meantime
+	if other.Media == nil || cfg.storedKey(other.VideoKey, nil) != key {
+		return processedVideo{}, false, nil
+	}
+
+	err = cfg.db.CreateVideoAsset(videoID, key, database.AssetKindVideo)
+	if err != nil {
+		return processedVideo{}, false, err
+	}
+	err = cfg.db.CopyVideoAssetsWithPrefix(other.ID, videoID, derivedPrefix(key))
+	if err != nil {
+		return processedVideo{}, false, err
+	}
+
+	out := processedVideo{
+		meta:              *other.Media,
+		manifests:         map[string]string{},
+		candidateVariants: map[string]database.ThumbnailVariants{},
+	}
+	if other.HLSKey != nil {
+		out.manifests["hls"] = *other.HLSKey
+	}
+	if other.DASHKey != nil {
+		out.manifests["dash"] = *other.DASHKey
+	}
+	candidates, err := cfg.db.GetVideoAssetsByKind(videoID, database.AssetKindThumbnailCandidate)
+	if err != nil {
+		return processedVideo{}, false, err
+	}
+	for _, c := range candidates {
+		if !strings.HasPrefix(c.Key, streamPrefix(key, "thumbnails")) {
+			continue
+		}
+		out.candidates = append(out.candidates, c.Key)
+		out.candidateVariants[c.Key], err = cfg.thumbnailVariants(c.Key)
+		if err != nil {
+			return processedVideo{}, false, err
+		}
+	}
+	if len(out.candidates) == 0 {
+		return processedVideo{}, false, nil
+	}
+	return out, true, nil
+}
+
+func manifestKey(manifests map[string]string, format string) *string {
+	key, ok := manifests[format]
+	if !ok {
+		return nil
+	}
+	return &key
+}
+
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// uploadSourceMaster keeps the upload as it was received next to the
+// processed video.
+func (cfg *apiConfig) uploadSourceMaster(ctx context.Context, videoID uuid.UUID, srcPath, mediaType, videoKey string) error {
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	key := streamPrefix(videoKey, "source") + "original" + mediaTypeToExt(mediaType)
+	if err := cfg.store.Put(ctx, key, f, mediaType); err != nil {
+		return fmt.Errorf("couldn't upload source master: %w", err)
+	}
+	if err := cfg.db.CreateVideoAsset(videoID, key, database.AssetKindSource); err != nil {
+		return fmt.Errorf("couldn't record source master: %w", err)
+	}
+	return nil
+}
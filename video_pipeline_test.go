@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/gpr3211/boot-s3-course/internal/database"
+	"github.com/gpr3211/boot-s3-course/internal/media"
+	"github.com/gpr3211/boot-s3-course/internal/storage"
+)
+
+// hdProbe is what the fake prober reports for a 10 second 1080p H.264/AAC
+// video.
+var hdProbe = media.Probe{
+	Format: media.Format{Name: "mov,mp4,m4a,3gp,3g2,mj2", Duration: 10, Size: 1000},
+	Streams: []media.Stream{
+		{Index: 0, CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080, FrameRate: 30},
+		{Index: 1, CodecType: "audio", CodecName: "aac", Channels: 2, SampleRate: 48000},
+	},
+}
+
+// newTestConfig is a server on a temporary database and local store whose
+// videos are probed by prober instead of ffprobe.
+func newTestConfig(t *testing.T, prober *media.Fake) *apiConfig {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := database.NewClient(filepath.Join(dir, "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewLocalStore(filepath.Join(dir, "assets"), "http://localhost:8091/assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiConfig{
+		db:                db,
+		jwtSecret:         "secret",
+		platform:          "dev",
+		assetsRoot:        filepath.Join(dir, "assets"),
+		store:             store,
+		uploadsDir:        filepath.Join(dir, "uploads"),
+		uploadLocks:       newUploadLocks(),
+		jobWake:           make(chan struct{}, 1),
+		prober:            prober,
+		allowedVideoTypes: map[string]bool{media.TypeMP4: true, media.TypeQuickTime: true, media.TypeWebM: true},
+	}
+}
+
+// writeMP4 writes a file SniffVideo takes for an MP4: an ftyp and an mdat box.
+func writeMP4(t *testing.T) string {
+	t.Helper()
+	box := func(typ string, payload []byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+		return append(append(b, typ...), payload...)
+	}
+	data := append(box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2")), box("mdat", make([]byte, 64))...)
+	path := filepath.Join(t.TempDir(), "upload.mp4")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func createTestVideo(t *testing.T, cfg *apiConfig, userID uuid.UUID) database.Video {
+	t.Helper()
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "test", UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return video
+}
+
+func TestProcessVideoProbeFails(t *testing.T) {
+	cfg := newTestConfig(t, &media.Fake{Err: errors.New("moov atom not found")})
+	video := createTestVideo(t, cfg, uuid.New())
+
+	var statuses []string
+	err := cfg.processVideo(context.Background(), video, writeMP4(t), media.TypeMP4, "", func(s string) {
+		statuses = append(statuses, s)
+	})
+	if err == nil {
+		t.Fatal("processVideo() succeeded on a video that doesn't probe")
+	}
+	if len(statuses) != 1 || statuses[0] != database.JobStatusProbing {
+		t.Errorf("statuses = %v, want only %s", statuses, database.JobStatusProbing)
+	}
+	got, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VideoKey != nil || got.Media != nil {
+		t.Errorf("failed processing changed the video: key %v, media %v", got.VideoKey, got.Media)
+	}
+}
+
+func TestProcessVideoNoVideoStream(t *testing.T) {
+	audioOnly := media.Probe{Streams: []media.Stream{{CodecType: "audio", CodecName: "mp3"}}}
+	cfg := newTestConfig(t, &media.Fake{Default: &audioOnly})
+	video := createTestVideo(t, cfg, uuid.New())
+
+	err := cfg.processVideo(context.Background(), video, writeMP4(t), media.TypeMP4, "", func(string) {})
+	if !errors.Is(err, media.ErrNoVideoStream) {
+		t.Errorf("processVideo() error = %v, want %v", err, media.ErrNoVideoStream)
+	}
+}
+
+// An upload already processed for another video is shared, which needs no
+// ffmpeg.
+func TestProcessVideoSharesProcessedUpload(t *testing.T) {
+	cfg := newTestConfig(t, &media.Fake{Default: &hdProbe})
+	userID := uuid.New()
+	const sum = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	key := SetAspectPrefix(contentKey(sum, media.TypeMP4), media.OrientationLandscape)
+	candidate := streamPrefix(key, "thumbnails") + "candidate_00.jpg"
+
+	first := createTestVideo(t, cfg, userID)
+	first.VideoKey = &key
+	first.ThumbnailKey = &candidate
+	if err := cfg.db.UpdateVideo(first); err != nil {
+		t.Fatal(err)
+	}
+	meta := database.VideoMedia{DurationSeconds: 10, Width: 1920, Height: 1080, VideoCodec: "h264", SHA256: "abc", SizeBytes: 1000}
+	if err := cfg.db.UpsertVideoMedia(first.ID, meta); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range []struct{ key, kind string }{
+		{key, database.AssetKindVideo},
+		{candidate, database.AssetKindThumbnailCandidate},
+	} {
+		if err := cfg.db.CreateVideoAsset(first.ID, a.key, a.kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cfg.db.AcquireBlob(key, sum, meta.SizeBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	second := createTestVideo(t, cfg, userID)
+	var statuses []string
+	err := cfg.processVideo(context.Background(), second, writeMP4(t), media.TypeMP4, sum, func(s string) {
+		statuses = append(statuses, s)
+	})
+	if err != nil {
+		t.Fatalf("processVideo() error = %v", err)
+	}
+	if len(statuses) != 1 {
+		t.Errorf("statuses = %v, want only probing, nothing was transcoded", statuses)
+	}
+
+	got, err := cfg.db.GetVideo(second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.VideoKey == nil || *got.VideoKey != key {
+		t.Errorf("VideoKey = %v, want %s", got.VideoKey, key)
+	}
+	if got.ThumbnailKey == nil || *got.ThumbnailKey != candidate {
+		t.Errorf("ThumbnailKey = %v, want the shared candidate %s", got.ThumbnailKey, candidate)
+	}
+	if got.Orientation == nil || *got.Orientation != string(media.OrientationLandscape) {
+		t.Errorf("Orientation = %v, want landscape", got.Orientation)
+	}
+	if got.AspectRatio == nil || *got.AspectRatio != "16:9" {
+		t.Errorf("AspectRatio = %v, want 16:9", got.AspectRatio)
+	}
+	if got.Media == nil || got.Media.SHA256 != meta.SHA256 || got.Media.DurationSeconds != meta.DurationSeconds {
+		t.Errorf("Media = %+v, want the first video's", got.Media)
+	}
+	assets, err := cfg.db.GetVideoAssetsByKind(second.ID, database.AssetKindThumbnailCandidate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 1 || assets[0].Key != candidate {
+		t.Errorf("candidate assets = %+v, want the shared candidate", assets)
+	}
+}